@@ -0,0 +1,68 @@
+package closer
+
+import (
+	"os"
+	"os/signal"
+)
+
+type actionKind int
+
+const (
+	actCleanup actionKind = iota
+	actReload
+	actIgnore
+	actCustom
+)
+
+// Action is what a closer does when it catches a signal, see SetSignalAction.
+type Action struct {
+	kind actionKind
+	fn   func(os.Signal)
+}
+
+var (
+	// Cleanup runs the defered funcs and exits, it's what the default signals do.
+	Cleanup = Action{kind: actCleanup}
+
+	// Reload runs the reload handlers registered with OnReload and keeps running.
+	Reload = Action{kind: actReload}
+
+	// Ignore drops the signal, the process keeps running as if it never arrived.
+	Ignore = Action{kind: actIgnore}
+)
+
+// Custom calls fn with the caught signal and keeps running, fn runs on the signal handler goroutine,
+// so it shouldn't block, signals caught in the meantime wait for it to return.
+func Custom(fn func(os.Signal)) Action {
+	return Action{kind: actCustom, fn: fn}
+}
+
+// SetSignalAction makes c handle sig with action, whether or not sig is part of the signals c was armed with.
+// Signals without an action keep the default behavior: the reload signal runs the reload handlers once there's one,
+// and the others trigger the cleanup, an explicit Cleanup makes the reload signal trigger the cleanup even then.
+// RemoveSignal drops the action along with the signal.
+func (c *Closer) SetSignalAction(sig os.Signal, action Action) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.actions == nil {
+		c.actions = map[os.Signal]Action{}
+	}
+	c.actions[sig] = action
+	if c.sigCh != nil {
+		signal.Notify(c.sigCh, sig)
+	}
+}
+
+// SetSignalAction makes the global closer handle sig with action.
+// See (*Closer).SetSignalAction.
+func SetSignalAction(sig os.Signal, action Action) {
+	get().SetSignalAction(sig, action)
+}
+
+// action returns the action set for sig and whether there was one.
+func (c *Closer) action(sig os.Signal) (Action, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	a, ok := c.actions[sig]
+	return a, ok
+}
@@ -0,0 +1,618 @@
+package closer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type closerFunc struct {
+	fn    func(ctx context.Context) error
+	index int // registration index within its closer
+	name  string
+	typ   string // the type of the registered value, for Plan
+
+	phase      InitPhase
+	group      int
+	concurrent bool
+	on         trigger // which cleanups run it, see DeferClean and DeferSignal
+	tag        string
+	when       func() bool // if set, fn is skipped when it returns false, see DeferIf
+	pinned     bool        // keeps its LIFO position whatever Order is, see DeferFirst and Barrier
+
+	after closerFuncs // funcs that have to run before this one, see DeferAfter
+}
+
+// exec calls fn of cf once, it must not be used on funcs shared with a Closer, see (*cleanupRun).runOne.
+func (cf *closerFunc) exec(ctx context.Context) (err error) {
+	fn := cf.fn
+	if fn == nil {
+		return
+	}
+	cf.fn = nil
+	return call(ctx, fn)
+}
+
+// call calls fn, converting panics to a *PanicError unless RecoverPanics is false.
+func call(ctx context.Context, fn func(context.Context) error) (err error) {
+	if !RecoverPanics {
+		return fn(ctx)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = &PanicError{Value: p, Stack: debug.Stack()}
+		}
+	}()
+	err = fn(ctx)
+	return
+}
+
+// label returns the name of cf, or "#<index>" if it is unnamed.
+func (cf *closerFunc) label() string {
+	if cf.name != "" {
+		return cf.name
+	}
+	return fmt.Sprintf("#%d", cf.index)
+}
+
+type closerFuncs []*closerFunc
+
+// errGoexit is reported for a func that called runtime.Goexit.
+var errGoexit = errors.New("closer: func called runtime.Goexit")
+
+// errAborted is reported for a func that didn't return when RecoverPanics is false.
+var errAborted = errors.New("closer: func panicked or called runtime.Goexit")
+
+// errStopped is the cause of the funcs skipped because of StopOnFirstError.
+var errStopped = errors.New("closer: stopped on the first error")
+
+// errWatchdog is passed to OnSkipped for the funcs abandoned by the exit forced by WatchdogTimeout.
+var errWatchdog = errors.New("closer: watchdog timeout, forcing exit")
+
+// errForced is passed to OnSkipped for the funcs abandoned by the exit forced by a second signal.
+var errForced = errors.New("closer: second signal, forcing exit")
+
+// reportSkipped passes the funcs of cfs to OnSkipped with reason.
+func reportSkipped(cfs closerFuncs, reason error) {
+	if OnSkipped == nil {
+		return
+	}
+	for _, cf := range cfs {
+		OnSkipped(cf.label(), reason)
+	}
+}
+
+// abandon passes the pending funcs of c to OnSkipped with reason, for the forced exits.
+func (c *Closer) abandon(reason error) {
+	if OnSkipped == nil {
+		return
+	}
+	c.mux.Lock()
+	cfs := c.closers.active()
+	c.mux.Unlock()
+	reportSkipped(cfs, reason)
+}
+
+// cleanupRun holds the state of a single cleanup.
+type cleanupRun struct {
+	c    *Closer
+	ctx  context.Context
+	stop context.CancelCauseFunc
+
+	mux    sync.Mutex
+	errs   []error
+	ran    int     // the number of funcs that ran
+	failed int     // the number of funcs that failed
+	report *Report // nil unless the run was started by CloseReport
+
+	skipped map[*closerFunc]bool // the funcs skipped once ctx was done, so next doesn't return them again
+}
+
+func (c *Closer) newRun(ctx context.Context) *cleanupRun {
+	r := &cleanupRun{c: c}
+	r.ctx, r.stop = context.WithCancelCause(ctx)
+	return r
+}
+
+// fail records and reports err, cf is nil for errors that aren't tied to a single func.
+func (r *cleanupRun) fail(cf *closerFunc, err error) {
+	r.mux.Lock()
+	r.errs = append(r.errs, err)
+	r.mux.Unlock()
+	reportError(cf, err)
+	if StopOnFirstError && cf != nil {
+		r.stop(errStopped)
+	}
+}
+
+// run executes the funcs returned by next in order, until it returns none,
+// the lock of c must not be held, so the funcs can register new ones.
+// once ctx is done, the passes still go through runPass, which skips and reports their funcs.
+func (r *cleanupRun) run(next func() closerFuncs) {
+	if OnBeforeCleanup != nil {
+		OnBeforeCleanup(signalFrom(r.ctx))
+	}
+	if OnAfterCleanup != nil {
+		start := time.Now()
+		defer func() { OnAfterCleanup(len(r.errs) > 0, time.Since(start)) }()
+	}
+	if JSONLog != nil {
+		start := time.Now()
+		defer func() {
+			writeJSON(jsonRecord{Closers: &r.ran, Errored: &r.failed, DurationMS: ms(time.Since(start)), Error: jsonErr(joinErrors(r.errs))})
+		}()
+	}
+	for cfs := r.unskipped(next()); len(cfs) > 0; cfs = r.unskipped(next()) {
+		r.runPass(cfs)
+	}
+}
+
+// unskipped returns the funcs of cfs that weren't skipped by an earlier pass, it reuses cfs' backing array.
+func (r *cleanupRun) unskipped(cfs closerFuncs) closerFuncs {
+	if len(r.skipped) == 0 {
+		return cfs
+	}
+	out := cfs[:0]
+	for _, cf := range cfs {
+		if !r.skipped[cf] {
+			out = append(out, cf)
+		}
+	}
+	return out
+}
+
+// runPass executes cfs in order, skipping the remaining ones once ctx is done.
+// Every func is attempted even if an earlier one panics or calls runtime.Goexit,
+// in the latter case the remaining ones run before the goroutine exits.
+func (r *cleanupRun) runPass(cfs closerFuncs) {
+	r.c.mux.Lock()
+	batches, err := cfs.batches()
+	r.c.mux.Unlock()
+	if err != nil {
+		r.fail(nil, err)
+	}
+	defer func() {
+		if len(batches) > 0 {
+			r.runPass(batches.flatten())
+		}
+	}()
+	for len(batches) > 0 {
+		if r.ctx.Err() != nil {
+			skipped := batches.flatten()
+			if r.skipped == nil {
+				r.skipped = make(map[*closerFunc]bool, len(skipped))
+			}
+			for _, cf := range skipped {
+				r.skipped[cf] = true
+			}
+			err := fmt.Errorf("closer: cleanup stopped, skipped %d funcs: %w", len(skipped), context.Cause(r.ctx))
+			reportSkipped(skipped, context.Cause(r.ctx))
+			batches = nil
+			r.fail(nil, err)
+			return
+		}
+		b := batches[0]
+		batches = batches[1:]
+		r.runBatch(b)
+	}
+}
+
+// batches returns cfs in execution order, higher groups first and per Order within a group,
+// with FIFO only the funcs between two pinned ones are reversed back to their registration order,
+// split into batches, where each batch has to finish before the next one starts.
+// concurrent funcs of the same group are put in a single batch that runs before the group's other funcs.
+// funcs defered after others run once all of them did, regardless of their group,
+// err is set if there's a dependency cycle, which is broken by running the first func of the cycle in that order.
+func (cfs closerFuncs) batches() (out batches, err error) {
+	order := make(closerFuncs, 0, len(cfs))
+	for end := len(cfs); end > 0; {
+		if Order == LIFO || cfs[end-1].pinned {
+			end--
+			order = append(order, cfs[end])
+			continue
+		}
+		start := end - 1
+		for start > 0 && !cfs[start-1].pinned {
+			start--
+		}
+		order = append(order, cfs[start:end]...)
+		end = start
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if a.phase != b.phase {
+			return a.phase > b.phase
+		}
+		if a.group != b.group {
+			return a.group > b.group
+		}
+		return a.concurrent && !b.concurrent
+	})
+	order, err = order.sortDeps()
+	for i, cf := range order {
+		if last := len(out) - 1; i > 0 && cf.concurrent && order[i-1].concurrent && order[i-1].phase == cf.phase && order[i-1].group == cf.group && !cf.dependsOn(out[last].has) {
+			out[last] = append(out[last], cf)
+			continue
+		}
+		out = append(out, closerFuncs{cf})
+	}
+	return
+}
+
+// sortDeps reorders cfs so every func comes after the ones it depends on, keeping their order otherwise.
+func (cfs closerFuncs) sortDeps() (out closerFuncs, err error) {
+	var hasDeps bool
+	for _, cf := range cfs {
+		hasDeps = hasDeps || len(cf.after) > 0
+	}
+	if !hasDeps {
+		return cfs, nil
+	}
+	left := make(map[*closerFunc]bool, len(cfs))
+	for _, cf := range cfs {
+		left[cf] = true
+	}
+	isLeft := func(cf *closerFunc) bool { return left[cf] }
+	out = make(closerFuncs, 0, len(cfs))
+	for len(out) < len(cfs) {
+		next := -1
+		for i, cf := range cfs {
+			if left[cf] && !cf.dependsOn(isLeft) {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			var labels []string
+			for i, cf := range cfs {
+				if left[cf] {
+					if next == -1 {
+						next = i
+					}
+					labels = append(labels, cf.label())
+				}
+			}
+			if err == nil {
+				err = fmt.Errorf("closer: dependency cycle between %s, running %s first", strings.Join(labels, ", "), labels[0])
+			}
+		}
+		left[cfs[next]] = false
+		out = append(out, cfs[next])
+	}
+	return
+}
+
+// dependsOn reports whether cf has to run after any of the funcs in reports true for.
+func (cf *closerFunc) dependsOn(in func(*closerFunc) bool) bool {
+	for _, dep := range cf.after {
+		if in(dep) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfs closerFuncs) has(cf *closerFunc) bool {
+	for _, o := range cfs {
+		if o == cf {
+			return true
+		}
+	}
+	return false
+}
+
+type batches []closerFuncs
+
+func (bs batches) flatten() (out closerFuncs) {
+	for _, b := range bs {
+		out = append(out, b...)
+	}
+	return
+}
+
+// runBatch executes all the funcs of b concurrently and waits for them to return.
+func (r *cleanupRun) runBatch(b closerFuncs) {
+	if len(b) == 1 {
+		r.runOne(b[0])
+		return
+	}
+	var (
+		wg  sync.WaitGroup
+		sem chan struct{}
+	)
+	if n := MaxConcurrentClosers; n > 0 && n < len(b) {
+		sem = make(chan struct{}, n)
+	}
+	wg.Add(len(b))
+	for _, cf := range b {
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		go func(cf *closerFunc) {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			r.runOne(cf)
+		}(cf)
+	}
+	wg.Wait()
+}
+
+// runOne executes cf unless it already ran or was cancelled, reports its error and emits its CloseEvent.
+func (r *cleanupRun) runOne(cf *closerFunc) {
+	c := r.c
+	c.mux.Lock()
+	fn := c.take(cf)
+	c.mux.Unlock()
+	if fn == nil {
+		return
+	}
+	if cf.name != "" {
+		c.logf("closer: running %s", cf.name)
+	}
+	var (
+		start   = time.Now()
+		err     = errGoexit
+		summary string
+	)
+	if !RecoverPanics {
+		err = errAborted
+	}
+	defer func() {
+		if OnClose != nil {
+			OnClose(cf.label(), summary, err)
+		}
+		if cf.name != "" {
+			c.logf("closer: %s returned after %v: %v", cf.name, time.Since(start), err)
+		}
+		ev := CloseEvent{Index: cf.index, Name: cf.name, Start: start, Duration: time.Since(start), Err: err, Summary: summary}
+		c.emit(ev)
+		r.mux.Lock()
+		if r.ran++; err != nil {
+			r.failed++
+		}
+		if r.report != nil {
+			r.report.add(ev)
+		}
+		r.mux.Unlock()
+		if JSONLog != nil {
+			writeJSON(jsonRecord{Name: cf.label(), Summary: summary, DurationMS: ms(ev.Duration), Error: jsonErr(err)})
+		}
+		if err != nil {
+			r.fail(cf, err)
+		}
+	}()
+	err = call(context.WithValue(r.ctx, summaryKey{}, &summary), fn)
+}
+
+// trigger restricts a func to the cleanups triggered by a signal or to the other ones.
+type trigger uint8
+
+const (
+	onAny trigger = iota
+	onClean
+	onSignal
+)
+
+// take returns the func of cf and marks it as done, or nil if it already ran or was cancelled,
+// the lock of c must be held.
+func (c *Closer) take(cf *closerFunc) func(context.Context) error {
+	fn := cf.fn
+	if fn != nil {
+		cf.fn = nil
+		atomic.AddInt32(&c.live, -1)
+	}
+	return fn
+}
+
+// drop cancels the funcs of cfs that don't run for the cleanup triggered by sig and returns the others,
+// the lock of c must be held.
+func (c *Closer) drop(cfs closerFuncs, sig os.Signal) closerFuncs {
+	skip := onSignal
+	if sig != nil {
+		skip = onClean
+	}
+	out := cfs[:0]
+	for _, cf := range cfs {
+		if cf.on == skip {
+			c.take(cf)
+			continue
+		}
+		out = append(out, cf)
+	}
+	return out
+}
+
+// runNow runs cfs outside of a drain and removes them from c once they ran, the lock of c must not be held.
+func (c *Closer) runNow(cfs closerFuncs) error {
+	defer func() {
+		c.mux.Lock()
+		c.closers = c.closers.pending()
+		c.mux.Unlock()
+	}()
+	r := c.newRun(context.Background())
+	r.run(func() (next closerFuncs) {
+		next, cfs = cfs, nil
+		return
+	})
+	return joinErrors(r.errs)
+}
+
+// active returns a copy of cfs without the funcs that were already executed or cancelled.
+func (cfs closerFuncs) active() closerFuncs {
+	out := make(closerFuncs, 0, len(cfs))
+	for _, cf := range cfs {
+		if cf.fn != nil {
+			out = append(out, cf)
+		}
+	}
+	return out
+}
+
+// pending returns the funcs of cfs that haven't been executed or cancelled yet, it reuses cfs' backing array.
+func (cfs closerFuncs) pending() closerFuncs {
+	out := cfs[:0]
+	for _, cf := range cfs {
+		if cf.fn != nil {
+			out = append(out, cf)
+		}
+	}
+	for i := len(out); i < len(cfs); i++ {
+		cfs[i] = nil
+	}
+	return out
+}
+
+var reportMux sync.Mutex
+
+// reportError passes err to OnErrorDetailed if set, otherwise to OnError,
+// cf is nil for errors that aren't tied to a single func.
+// calls are serialized so the callbacks don't have to be safe for concurrent use,
+// and a panicking callback is recovered and written to Logger or os.Stderr, so it can't stop the cleanup.
+// with AsyncOnError, err is queued for the error goroutine instead.
+func reportError(cf *closerFunc, err error) {
+	idx, name := -1, ""
+	if cf != nil {
+		idx, name = cf.index, cf.name
+	}
+	if AsyncOnError {
+		asyncErrs.once.Do(func() { go asyncErrs.loop() })
+		asyncErrs.add()
+		asyncErrs.ch <- asyncError{idx, name, err}
+		return
+	}
+	deliverError(idx, name, err)
+}
+
+func deliverError(idx int, name string, err error) {
+	reportMux.Lock()
+	defer reportMux.Unlock()
+	defer func() {
+		if p := recover(); p != nil {
+			if Logger != nil {
+				logf("closer: error handler panicked on %v: %v", err, p)
+			} else {
+				fmt.Fprintf(os.Stderr, "closer: error handler panicked on %v: %v\n", err, p)
+			}
+		}
+	}()
+	settings.RLock()
+	detailed, onError := OnErrorDetailed, OnError
+	settings.RUnlock()
+	if detailed != nil {
+		detailed(idx, name, err)
+	} else if onError != nil {
+		onError(err)
+	}
+}
+
+type asyncError struct {
+	idx  int
+	name string
+	err  error
+}
+
+// errorQueue holds the errors queued with AsyncOnError, a single goroutine delivers them in order.
+// queuing and flushing can happen concurrently from different closers, so unlike a sync.WaitGroup,
+// the pending count can grow while a flush waits.
+type errorQueue struct {
+	once sync.Once
+	ch   chan asyncError
+
+	mux     sync.Mutex
+	pending int           // the number of queued errors that weren't delivered yet
+	idle    chan struct{} // closed once pending drops to 0, nil if nobody waits for it
+}
+
+var asyncErrs = &errorQueue{ch: make(chan asyncError, 64)}
+
+func (q *errorQueue) loop() {
+	for e := range q.ch {
+		deliverError(e.idx, e.name, e.err)
+		q.done()
+	}
+}
+
+// add marks an error as queued.
+func (q *errorQueue) add() {
+	q.mux.Lock()
+	q.pending++
+	q.mux.Unlock()
+}
+
+// done marks a queued error as delivered.
+func (q *errorQueue) done() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.pending--; q.pending == 0 && q.idle != nil {
+		close(q.idle)
+		q.idle = nil
+	}
+}
+
+// flush waits for the queued errors to be delivered.
+func (q *errorQueue) flush() { q.flushContext(context.Background()) }
+
+// flushContext is like flush, except it gives up once ctx is done.
+func (q *errorQueue) flushContext(ctx context.Context) error {
+	q.mux.Lock()
+	if q.pending == 0 {
+		q.mux.Unlock()
+		return nil
+	}
+	if q.idle == nil {
+		q.idle = make(chan struct{})
+	}
+	idle := q.idle
+	q.mux.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type reasonKey struct{}
+
+// summaryKey holds the *string a func() (string, error) stores its summary in.
+type summaryKey struct{}
+
+// reasonFrom returns the reason of the cleanup ctx belongs to.
+func reasonFrom(ctx context.Context) Reason {
+	why, _ := ctx.Value(reasonKey{}).(Reason)
+	return why
+}
+
+// signalFrom returns the signal that triggered the cleanup ctx belongs to, or nil.
+func signalFrom(ctx context.Context) os.Signal {
+	return reasonFrom(ctx).Signal
+}
+
+// shutdownContext returns the context used for a full cleanup derived from parent,
+// bound by the cleanup timeout of c and the shutdown deadline if set, whichever comes first.
+func (c *Closer) shutdownContext(parent context.Context) (context.Context, context.CancelFunc) {
+	settings.RLock()
+	deadline, timeout := shutdownDeadline, CleanupTimeout
+	settings.RUnlock()
+	if c.timeout > 0 {
+		timeout = c.timeout
+	}
+	if timeout > 0 {
+		if t := time.Now().Add(timeout); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	if !deadline.IsZero() {
+		return context.WithDeadline(parent, deadline)
+	}
+	return context.WithCancel(parent)
+}
@@ -1,167 +1,2080 @@
 package closer
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
+// The settings are read by the signal handler goroutine, assign them before any closer is armed,
+// or use the Set funcs, like SetOnError and SetExitCodeErr, for the ones that may change later.
 var (
 	ExitWithSignalCode = false // if true, the singal handler exits with the caught signal code rather than ExitCodeErr
 
 	ExitCodeOk  = 0 // the exit code used when there were no errors returned
 	ExitCodeErr = 1 // the exit code used when one or more of the defered returns an error
 
-	// DefaultSignals are the default signals handled by closer, you may append or change them to your liking.
-	// note that once .Defer, .Init or .Exit are called, changing them doesn't change anything.
-	DefaultSignals = []os.Signal{
-		syscall.SIGINT,
-		syscall.SIGHUP,
-		syscall.SIGTERM,
-	}
+	// ExitCodeFunc if set, overrides how the exit code is picked by the signal handler and Exit(-1),
+	// sig is nil when exiting through Exit.
+	ExitCodeFunc func(sig os.Signal, errored bool) int
 
 	OnError func(err error)
+
+	// OnFatal if set, is called with the error passed to ExitErr instead of OnError,
+	// so the fatal error can be logged apart from the errors of the defered funcs.
+	OnFatal func(err error)
+
+	// OnErrorDetailed if set, is called instead of OnError with the registration index and name of the failed func,
+	// index is -1 and name is empty for errors that aren't tied to a single func.
+	OnErrorDetailed func(index int, name string, err error)
+
+	// OnClose if set, is called every time a defered func returns, with its label as listed by Registered,
+	// the summary returned by a func() (string, error) or "" for the other funcs, and its error.
+	OnClose func(name, summary string, err error)
+
+	// OnUnsupported if set, is called with the values passed to Defer that aren't one of the supported closers,
+	// it can adapt v by returning a func and true, or skip it by returning a nil func and true,
+	// if it returns false, Defer panics like it does when OnUnsupported is nil.
+	OnUnsupported func(v interface{}) (func() error, bool)
+
+	// OnSkipped if set, is called for every defered func that won't run because the cleanup ran out of budget,
+	// including when it already did before the cleanup started or by the time a func defers new ones,
+	// with its label as listed by Registered and why: context.DeadlineExceeded with CleanupTimeout or SetShutdownDeadline,
+	// the cause of a CloseCtx context, or an error for StopOnFirstError, WatchdogTimeout and ForceExitOnSecondSignal,
+	// in the last two cases it's called right before ExitFunc, from the goroutine forcing the exit.
+	OnSkipped func(name string, reason error)
+
+	// OnBeforeCleanup if set, is called before the defered funcs start running, on every cleanup path,
+	// sig is the caught signal or nil.
+	OnBeforeCleanup func(sig os.Signal)
+
+	// OnAfterCleanup if set, is called after the defered funcs of a cleanup finished running,
+	// with whether any of them errored and how long it took.
+	OnAfterCleanup func(errored bool, d time.Duration)
+
+	// CleanupTimeout if > 0, bounds the total time a signal, Exit or Close cleanup may take,
+	// once it is exceeded the remaining funcs are skipped and the cleanup is considered errored.
+	// context-aware funcs get it as their context's deadline.
+	// note that it doesn't interrupt a func that is already running, it only stops the next ones from starting.
+	CleanupTimeout time.Duration
+
+	// Logger if set, is used to log the caught signals, the named funcs as they run and the exit code.
+	Logger Printfer
+
+	// IgnoreAlreadyClosed if true, os.ErrClosed and net.ErrClosed returned by a defered io.Closer are treated as success,
+	// it doesn't apply to funcs, which may want to report them.
+	IgnoreAlreadyClosed = true
+
+	// RecoverPanics if true, panics in the defered funcs are recovered and reported as a *PanicError,
+	// set it to false to let them crash the process, e.g. in tests.
+	RecoverPanics = true
+
+	// RepanicOnCrash if true, HandleCrash panics again with the recovered value after the cleanup, instead of exiting.
+	RepanicOnCrash = false
+
+	// StopOnFirstError if true, the first func that fails stops the cleanup, the remaining funcs are skipped
+	// and reported as a single error, so the cleanup is considered errored.
+	// the other funcs of a running DeferGroup group are still waited for, but their context is cancelled.
+	StopOnFirstError = false
+
+	// MaxConcurrentClosers if > 0, bounds how many funcs of a DeferGroup group run at the same time,
+	// groups still finish before the next one starts.
+	MaxConcurrentClosers = 0
+
+	// MaxClosers if > 0, caps how many funcs may be pending on a closer at once.
+	// a registration that would exceed it is dropped as a whole: none of its funcs will run,
+	// a *TooManyClosersError is reported to OnError, or OnErrorDetailed, and returned by the func DeferE returns,
+	// the funcs returned by the other Defer variants are no-ops.
+	MaxClosers = 0
+
+	// AsyncOnError if true, the errors are queued and passed to OnError, or OnErrorDetailed, by a dedicated goroutine,
+	// so a slow error handler doesn't hold up the cleanup, they're still delivered one at a time and in order.
+	// the signal handler and Exit wait for the queued errors to be delivered before calling ExitFunc,
+	// except for the forced exits, see ForceExitOnSecondSignal and WatchdogTimeout.
+	// reporting blocks once 64 errors are queued.
+	AsyncOnError = false
+
+	// JSONLog if set, gets a JSON object per line for every defered func that ran during a cleanup,
+	// {"name":..,"duration_ms":..,"error":..}, followed by a summary {"closers":..,"errored":..,"duration_ms":..,"error":..}.
+	// writes are serialized.
+	JSONLog io.Writer
+
+	// Order controls the order the defered funcs of the same group run in, LIFO by default,
+	// DeferFirst and Barrier funcs keep their LIFO position either way.
+	Order = LIFO
+
+	// ForceExitOnSecondSignal if true, a signal caught while the signal handler is still cleaning up
+	// exits immediately without waiting for the remaining funcs.
+	ForceExitOnSecondSignal = true
+
+	// DumpOnSIGQUIT if true, the stacks of all goroutines are written to Logger, or os.Stderr if it's nil,
+	// when a cleanup is triggered by SIGQUIT, before any of the defered funcs run.
+	// SIGQUIT isn't part of the default signals, so it has to be added to them or passed to SetSignals.
+	DumpOnSIGQUIT = false
+
+	// WatchdogTimeout if > 0, bounds how long the signal handler and Exit wait for the cleanup,
+	// once it's exceeded ExitFunc is called with the error exit code from another goroutine,
+	// even if a func is blocked and ignores its context, unlike CleanupTimeout.
+	WatchdogTimeout time.Duration
+
+	// GracePeriod if > 0, is how long the process has to cleanup before being killed, like the
+	// terminationGracePeriodSeconds of a kubernetes pod, which sends SIGTERM then SIGKILL once it's over.
+	// SIGKILL can't be caught, so once a cleanup ran for 80% of it, a warning is logged to Logger
+	// to help spotting the funcs that get close to the deadline, it doesn't stop the cleanup, see WatchdogTimeout.
+	GracePeriod time.Duration
+
+	// SignalBufferSize is the buffer size of the channel signals are delivered on, values < 1 mean 1.
+	// signals that arrive while the buffer is full are dropped by the runtime, a bigger buffer keeps bursts,
+	// but note that with ForceExitOnSecondSignal, any buffered signal after the first one forces an exit
+	// as soon as the cleanup starts.
+	// like the default signals, it's only used when a closer is armed.
+	SignalBufferSize = 1
+
+	// ExitFunc is called by Exit and the signal handler to terminate the process,
+	// it can be replaced to capture the exit code in tests.
+	ExitFunc = os.Exit
 )
 
-type closerFunc struct {
-	fn func() error
+// Printfer is implemented by loggers like *log.Logger.
+type Printfer interface {
+	Printf(format string, v ...interface{})
 }
 
-func (cf *closerFunc) exec() (err error) {
-	if cf.fn == nil {
-		return
+// Ordering is the order the defered funcs run in.
+type Ordering int
+
+const (
+	LIFO Ordering = iota // the last registered func runs first
+	FIFO                 // funcs run in the order they were registered
+)
+
+// Closer is an independent shutdown scope, it has its own signal handler and closer stack.
+// The zero value is not usable, use New.
+type Closer struct {
+	mux     sync.Mutex
+	sigCh   chan os.Signal
+	closers closerFuncs
+	nextIdx int
+	live    int32 // the number of pending funcs, accessed atomically for the fast paths
+
+	listening int32 // whether sigCh is armed, accessed atomically
+	clean     int32 // whether c was drained without errors, accessed atomically for the fast path of drain
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	signals   []os.Signal // the signals c is armed with
+	waiters   []chan os.Signal
+	reloaders []func() error
+	notify    []chan<- os.Signal
+	observers []chan os.Signal
+
+	drained     bool
+	drainDone   chan struct{}
+	drainErrs   []error
+	lastErrored bool      // whether the last drain errored, kept across Reset
+	lastSig     os.Signal // the signal that triggered the last drain, kept across Reset
+	lastReason  Reason    // the reason of the last drain, kept across Reset
+
+	evMux    sync.Mutex
+	evSubs   []*eventSub
+	evClosed []*eventSub // the closed subs, kept for Flush until their events were received
+	evDone   bool        // set once the drain finished and the subs were closed, new subs start closed
+
+	codes  *exitCodes // nil means the package level settings
+	noExit bool
+
+	// set by the options passed to New, the zero values mean the package level settings.
+	timeout  time.Duration
+	logger   Printfer
+	exitFunc func(code int)
+
+	held int
+
+	served chan servedSignal // set in sync mode, hands the caught signals to ServeSignals
+
+	actions map[os.Signal]Action // set by SetSignalAction
+
+	onceKeys map[string]struct{}
+
+	shared bool // set by WithCloseAll
+}
+
+func newCloser() *Closer {
+	c := &Closer{drainDone: make(chan struct{})}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
+}
+
+// New returns a new Closer configured with opts, by default it handles DefaultSignals()
+// and uses the package level settings.
+func New(opts ...Option) *Closer {
+	c := newCloser()
+	for _, opt := range opts {
+		opt(c)
 	}
-	defer func() {
-		if p := recover(); p != nil {
-			if perr, ok := p.(error); ok {
-				err = perr
-			} else {
-				err = fmt.Errorf("panic: %v", p)
+	c.reinit(false, c.signals...)
+	if c.shared {
+		remember(c)
+	}
+	return c
+}
+
+// instances holds the Closers created with WithCloseAll that weren't drained or stopped yet, used by CloseAll.
+var instances struct {
+	sync.Mutex
+	list []*Closer
+}
+
+func remember(c *Closer) {
+	instances.Lock()
+	instances.list = append(instances.list, c)
+	instances.Unlock()
+}
+
+func forget(c *Closer) {
+	instances.Lock()
+	defer instances.Unlock()
+	for i, ic := range instances.list {
+		if ic == c {
+			instances.list = append(instances.list[:i], instances.list[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *Closer) waitForSignal(ch chan os.Signal) {
+	for sig := range ch {
+		c.observe(sig)
+		if c.dropped() {
+			continue
+		}
+		switch a, ok := c.action(sig); a.kind {
+		case actReload:
+			c.runReloaders()
+			continue
+		case actIgnore:
+			continue
+		case actCustom:
+			a.fn(sig)
+			continue
+		default:
+			if !ok && c.reload(sig) {
+				continue
 			}
 		}
+		if c.notifyWaiters(sig) {
+			continue
+		}
+		c.logf("closer: caught %v, cleaning up", sig)
+		c.forward(sig)
+		if DumpOnSIGQUIT && quitSignal != nil && sig == quitSignal {
+			c.dumpStacks()
+		}
+		c.mux.Lock()
+		c.cancel()
+		served := c.served
+		c.mux.Unlock()
+		if served != nil {
+			done := make(chan struct{})
+			served <- servedSignal{ch, sig, done}
+			<-done
+			continue
+		}
+		c.shutdown(ch, sig)
+	}
+}
+
+type servedSignal struct {
+	ch   chan os.Signal
+	sig  os.Signal
+	done chan struct{}
+}
+
+// ServeSignals switches c to sync mode, where the signal handler doesn't cleanup by itself,
+// instead ServeSignals blocks until a signal is caught and runs the cleanup and exit inline,
+// on the calling goroutine, or returns after the cleanup if c doesn't exit, see (*Closer).NoExit.
+// Use WithSyncSignal so signals caught before ServeSignals is called wait for it.
+func (c *Closer) ServeSignals() {
+	c.arm()
+	c.mux.Lock()
+	if c.served == nil {
+		c.served = make(chan servedSignal)
+	}
+	served := c.served
+	c.mux.Unlock()
+	s := <-served
+	defer close(s.done)
+	c.shutdown(s.ch, s.sig)
+}
+
+// shutdown runs the cleanup triggered by sig and exits, another signal on ch forces the exit.
+func (c *Closer) shutdown(ch chan os.Signal, sig os.Signal) {
+	c.mux.Lock()
+	noExit := c.noExit
+	c.mux.Unlock()
+	if noExit {
+		c.cleanup(Reason{Signal: sig})
+		return
+	}
+	done := make(chan struct{})
+	if ForceExitOnSecondSignal {
+		go c.forceExit(ch, done)
+	}
+	errored, stop := true, c.watchdog()
+	defer func() { // deferred so it still exits if a func calls runtime.Goexit
+		stop()
+		close(done)
+		c.exit(c.exitCode(sig, errored))
 	}()
-	err, cf.fn = cf.fn(), nil
-	return
+	errored = len(c.cleanup(Reason{Signal: sig})) > 0
+}
+
+// forceExit exits as soon as another signal is caught on ch, unless done is closed first or c is stopped.
+func (c *Closer) forceExit(ch chan os.Signal, done chan struct{}) {
+	select {
+	case sig, ok := <-ch:
+		if !ok {
+			return
+		}
+		c.logf("closer: caught %v during cleanup, forcing exit", sig)
+		c.abandon(errForced)
+		c.exitNow(c.exitCode(sig, true))
+	case <-done:
+	}
+}
+
+// graceWarning logs a warning once the cleanup ran for 80% of GracePeriod, until stop is called.
+func (c *Closer) graceWarning() (stop func()) {
+	d := GracePeriod
+	if d <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(d*8/10, func() {
+		c.logf("closer: cleanup still running after 80%% of the %v grace period, the process may be killed soon", d)
+	})
+	return func() { t.Stop() }
+}
+
+// watchdog exits with the error exit code if the cleanup takes longer than WatchdogTimeout, until stop is called.
+func (c *Closer) watchdog() (stop func()) {
+	d := WatchdogTimeout
+	if d <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(d, func() {
+		c.logf("closer: cleanup didn't finish within %v, forcing exit", d)
+		c.abandon(errWatchdog)
+		c.exitNow(c.exitCode(nil, true))
+	})
+	return func() { t.Stop() }
+}
+
+// exit delivers the errors queued with AsyncOnError, then exits with code.
+func (c *Closer) exit(code int) {
+	asyncErrs.flush()
+	c.exitNow(code)
+}
+
+// exitNow exits with code without waiting for the queued errors, for the forced exits.
+func (c *Closer) exitNow(code int) {
+	c.logf("closer: exiting with code %d", code)
+	if c.exitFunc != nil {
+		c.exitFunc(code)
+		return
+	}
+	ExitFunc(code)
+}
+
+// logf logs to the logger of c, or Logger.
+func (c *Closer) logf(format string, v ...interface{}) {
+	if c.logger != nil {
+		c.logger.Printf(format, v...)
+		return
+	}
+	logf(format, v...)
+}
+
+// dumpStacks writes the stacks of all the goroutines to the logger of c, Logger or os.Stderr.
+func (c *Closer) dumpStacks() {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	if c.logger != nil || Logger != nil {
+		c.logf("closer: goroutine dump:\n%s", buf)
+		return
+	}
+	os.Stderr.Write(buf)
+}
+
+func logf(format string, v ...interface{}) {
+	if Logger != nil {
+		Logger.Printf(format, v...)
+	}
+}
+
+// exitCodes holds the exit code settings of a Closer.
+type exitCodes struct {
+	ok, err   int
+	useSignal bool
+}
+
+// exitCode returns the exit code for a cleanup triggered by sig (nil for Exit) that errored or not.
+// signal triggered cleanups always use the error code or the signal code, unless ExitCodeFunc is set.
+func (c *Closer) exitCode(sig os.Signal, errored bool) int {
+	settings.RLock()
+	fn, codes := ExitCodeFunc, exitCodes{ExitCodeOk, ExitCodeErr, ExitWithSignalCode}
+	settings.RUnlock()
+	if fn != nil {
+		return fn(sig, errored)
+	}
+	c.mux.Lock()
+	if c.codes != nil {
+		codes = *c.codes
+	}
+	c.mux.Unlock()
+	if sig != nil {
+		if sig, ok := sig.(syscall.Signal); ok && codes.useSignal {
+			return int(sig)
+		}
+		return codes.err
+	}
+	if errored {
+		return codes.err
+	}
+	return codes.ok
+}
+
+// SetExitCodes sets the exit codes c uses instead of ExitCodeOk, ExitCodeErr and ExitWithSignalCode,
+// until it's called, c uses the package level ones, ExitCodeFunc still overrides them if it's set.
+func (c *Closer) SetExitCodes(ok, err int, useSignal bool) {
+	c.mux.Lock()
+	c.codes = &exitCodes{ok, err, useSignal}
+	c.mux.Unlock()
+}
+
+// NoExit makes the signal handler of c run the cleanup without ever calling ExitFunc, not even on a second signal,
+// leaving the process lifetime to the host, e.g. for libraries and plugins, use Done to know when it finished.
+// Exit still calls ExitFunc.
+func (c *Closer) NoExit() {
+	c.mux.Lock()
+	c.noExit = true
+	c.mux.Unlock()
+}
+
+// waiter is implemented by *sync.WaitGroup.
+type waiter interface {
+	Wait()
 }
 
-type closerFuncs []closerFunc
+// ctxCloser is implemented by resources that take a shutdown context in Close.
+type ctxCloser interface {
+	Close(context.Context) error
+}
 
-func (cfs closerFuncs) cleanup() bool {
-	var errored bool
-	for i := len(cfs) - 1; i > -1; i-- {
-		if err := cfs[i].exec(); err != nil {
-			errored = true
-			if OnError != nil {
-				OnError(err)
+// toFunc converts one of the supported closer types to a context-aware func.
+func toFunc(fn interface{}) func(context.Context) error {
+	switch fn := fn.(type) {
+	case func():
+		return func(context.Context) error { fn(); return nil }
+	case context.CancelFunc: // it's a named type, so func() doesn't match it
+		return func(context.Context) error { fn(); return nil }
+	case context.CancelCauseFunc:
+		return func(context.Context) error { fn(ErrShutdown); return nil }
+	case func() error:
+		return func(context.Context) error { return fn() }
+	case func() (string, error):
+		return func(ctx context.Context) error {
+			s, err := fn()
+			if p, ok := ctx.Value(summaryKey{}).(*string); ok {
+				*p = s
+			}
+			return err
+		}
+	case func(context.Context) error:
+		return fn
+	case func(os.Signal) error:
+		return func(ctx context.Context) error { return fn(signalFrom(ctx)) }
+	case func(Reason) error:
+		return func(ctx context.Context) error { return fn(reasonFrom(ctx)) }
+	case ctxCloser:
+		return fn.Close
+	case io.Closer:
+		return func(context.Context) error { return closeErr(fn.Close()) }
+	case waiter:
+		return func(context.Context) error { fn.Wait(); return nil }
+	default:
+		if OnUnsupported != nil {
+			if cfn, ok := OnUnsupported(fn); ok {
+				if cfn == nil {
+					return func(context.Context) error { return nil }
+				}
+				return func(context.Context) error { return cfn() }
 			}
 		}
+		panic("supported closers: func(), func() error, func() (string, error), func(context.Context) error, func(os.Signal) error, func(Reason) error, context.CancelCauseFunc, io.Closer, interface{ Close(context.Context) error } and interface{ Wait() }")
 	}
-	return errored
 }
 
-type closer struct {
-	sync.Mutex
-	sync.Once
-	sigCh   chan os.Signal
-	closers closerFuncs
+// closeErr drops the already closed errors returned by an io.Closer if IgnoreAlreadyClosed is set.
+func closeErr(err error) error {
+	if IgnoreAlreadyClosed && (errors.Is(err, os.ErrClosed) || errors.Is(err, net.ErrClosed)) {
+		return nil
+	}
+	return err
 }
 
-func (c *closer) waitForSignal() {
-	for sig := range c.sigCh {
-		c.Lock()
-		c.closers.cleanup()
-		c.Unlock()
-		if sig, ok := sig.(syscall.Signal); ok && ExitWithSignalCode {
-			os.Exit(int(sig))
-		} else {
-			os.Exit(ExitCodeErr)
+// withTimeout wraps fn so waiting for it is abandoned after d.
+// context-aware funcs get a context with that deadline, the rest are run in their own goroutine,
+// which is leaked if they never return.
+func withTimeout(d time.Duration, fn interface{}) func(context.Context) error {
+	cfn := toFunc(fn)
+	switch fn.(type) {
+	case func(context.Context) error, ctxCloser:
+		return func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			return cfn(ctx)
+		}
+	}
+	return func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		ch := make(chan error, 1)
+		go func() {
+			cf := closerFunc{fn: cfn}
+			ch <- cf.exec(ctx)
+		}()
+		select {
+		case err := <-ch:
+			return err
+		case <-ctx.Done():
+			return fmt.Errorf("closer: timed out after %v: %w", d, ctx.Err())
+		}
+	}
+}
+
+// dropped reports whether signals are currently held.
+func (c *Closer) dropped() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.held > 0
+}
+
+// reload runs the reload handlers if sig is the reload signal and there's at least one of them.
+func (c *Closer) reload(sig os.Signal) bool {
+	if reloadSignal == nil || sig != reloadSignal {
+		return false
+	}
+	c.mux.Lock()
+	n := len(c.reloaders)
+	c.mux.Unlock()
+	if n == 0 {
+		return false
+	}
+	c.runReloaders()
+	return true
+}
+
+// runReloaders runs the reload handlers in order, stopping at the first one that fails.
+func (c *Closer) runReloaders() {
+	c.mux.Lock()
+	fns := c.reloaders
+	c.mux.Unlock()
+	for _, fn := range fns {
+		cf := closerFunc{fn: toFunc(fn), index: -1, name: "reload"}
+		if err := cf.exec(context.Background()); err != nil {
+			reportError(&cf, fmt.Errorf("closer: reload aborted: %w", err))
+			break
+		}
+	}
+}
+
+// notifyWaiters hands sig over to the goroutines blocked in Wait, if any.
+func (c *Closer) notifyWaiters(sig os.Signal) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if len(c.waiters) == 0 {
+		return false
+	}
+	for _, ch := range c.waiters {
+		ch <- sig
+	}
+	c.waiters = nil
+	return true
+}
+
+// observe sends sig to the channels returned by SignalChan, without blocking.
+func (c *Closer) observe(sig os.Signal) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, ch := range c.observers {
+		select {
+		case ch <- sig:
+		default:
+		}
+	}
+}
+
+// forward sends sig to the channels registered with Notify, without blocking.
+func (c *Closer) forward(sig os.Signal) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, ch := range c.notify {
+		select {
+		case ch <- sig:
+		default:
 		}
 	}
 }
 
-func (c *closer) deferFuncs(fns ...interface{}) func() {
+func (c *Closer) deferFuncs(fns ...interface{}) *Handle {
+	return c.add(closerFunc{}, false, fns...)
+}
+
+// add registers fns with the settings of tmpl, at the bottom of the stack if first is true.
+func (c *Closer) add(tmpl closerFunc, first bool, fns ...interface{}) *Handle {
+	c.arm()
 	cfs := make(closerFuncs, len(fns))
 	for i, fn := range fns {
-		cfn := &cfs[i]
-		switch fn := fn.(type) {
-		case func():
-			cfn.fn = func() error { fn(); return nil }
-		case func() error:
-			cfn.fn = fn
-		case io.Closer:
-			cfn.fn = fn.Close
-		default:
-			panic("supported closers: func(), func() error and io.Closer")
+		cf := tmpl
+		cf.fn = toFunc(fn)
+		if when := cf.when; when != nil {
+			fn := cf.fn
+			cf.fn = func(ctx context.Context) error {
+				if !when() {
+					return nil
+				}
+				return fn(ctx)
+			}
 		}
+		cf.typ = fmt.Sprintf("%T", fn)
+		cfs[i] = &cf
 	}
-	c.Lock()
-	c.closers = append(c.closers, cfs...)
-	c.Unlock()
-	return func() {
-		c.Lock()
-		cfs.cleanup()
-		c.Unlock()
+	c.mux.Lock()
+	if max := MaxClosers; max > 0 && int(atomic.LoadInt32(&c.live))+len(cfs) > max {
+		c.mux.Unlock()
+		err := &TooManyClosersError{Dropped: len(cfs), Max: max}
+		reportError(nil, err)
+		return &Handle{c: c, err: err}
 	}
+	for _, cf := range cfs {
+		cf.index = c.nextIdx
+		c.nextIdx++
+	}
+	atomic.AddInt32(&c.live, int32(len(cfs)))
+	if first {
+		c.closers = append(cfs[:len(cfs):len(cfs)], c.closers...)
+	} else {
+		c.closers = append(c.closers, cfs...)
+	}
+	c.mux.Unlock()
+	return &Handle{c: c, cfs: cfs}
 }
 
-func (c *closer) reinit(force bool, signals ...os.Signal) {
+func (c *Closer) reinit(force bool, signals ...os.Signal) {
 	if len(signals) == 0 {
-		signals = DefaultSignals
+		signals = DefaultSignals()
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.sigCh != nil && !force {
+		return
+	}
+	c.signals = append([]os.Signal(nil), signals...)
+	if c.sigCh != nil {
+		c.rearm()
+		return
+	}
+	n := SignalBufferSize
+	if n < 1 {
+		n = 1
 	}
-	c.Lock()
-	defer c.Unlock()
+	c.sigCh = make(chan os.Signal, n)
+	go c.waitForSignal(c.sigCh)
+	signal.Notify(c.sigCh, c.armed()...)
+	atomic.StoreInt32(&c.listening, 1)
+}
+
+// arm arms c with the signals it was last armed with, or the default ones, unless it already is.
+func (c *Closer) arm() {
+	if atomic.LoadInt32(&c.listening) == 1 {
+		return
+	}
+	c.mux.Lock()
+	sigs := c.signals
+	c.mux.Unlock()
+	c.reinit(false, sigs...)
+}
+
+// Stop stops c from handling signals, it unregisters them so they get their default behavior back,
+// and ends the goroutine c handles them in, the defered funcs stay registered.
+// c is armed again with the same signals by the next Defer call, or SetSignals.
+// a cleanup the signal handler already started keeps running, but a second signal no longer forces the exit.
+// A closer created with WithCloseAll is no longer drained by CloseAll once stopped.
+func (c *Closer) Stop() {
+	if c.shared {
+		forget(c)
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	if c.sigCh == nil {
-		c.sigCh = make(chan os.Signal, 1)
-		go c.waitForSignal()
-	} else if !force {
 		return
-	} else {
+	}
+	signal.Stop(c.sigCh)
+	close(c.sigCh)
+	c.sigCh = nil
+	atomic.StoreInt32(&c.listening, 0)
+}
+
+// armed returns the signals c should be notified of, including the reload signal if there are reload handlers
+// and the signals with an action.
+func (c *Closer) armed() []os.Signal {
+	sigs := c.signals
+	if len(c.reloaders) > 0 && reloadSignal != nil && !hasSignal(sigs, reloadSignal) {
+		sigs = append(sigs[:len(sigs):len(sigs)], reloadSignal)
+	}
+	for sig := range c.actions {
+		if !hasSignal(sigs, sig) {
+			sigs = append(sigs[:len(sigs):len(sigs)], sig)
+		}
+	}
+	return sigs
+}
+
+// rearm replaces the signals c is notified of with armed(), the lock must be held.
+// the kept signals are caught by a temporary channel in the meantime, so they never get their default behavior.
+func (c *Closer) rearm() {
+	sigs := c.armed()
+	if len(sigs) == 0 { // signal.Notify with no signals means all of them
 		signal.Stop(c.sigCh)
+		return
+	}
+	tmp := make(chan os.Signal, len(sigs))
+	signal.Notify(tmp, sigs...)
+	signal.Stop(c.sigCh)
+	signal.Notify(c.sigCh, sigs...)
+	signal.Stop(tmp)
+	for len(tmp) > 0 {
+		select {
+		case c.sigCh <- <-tmp:
+		default:
+		}
 	}
-	signal.Notify(c.sigCh, signals...)
+}
 
+func hasSignal(sigs []os.Signal, sig os.Signal) bool {
+	for _, s := range sigs {
+		if s == sig {
+			return true
+		}
+	}
+	return false
 }
 
-var gC closer
+// AddSignal makes c handle sigs as well as the signals it's already armed with.
+func (c *Closer) AddSignal(sigs ...os.Signal) {
+	if len(sigs) == 0 { // signal.Notify with no signals means all of them
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, sig := range sigs {
+		if !hasSignal(c.signals, sig) {
+			c.signals = append(c.signals, sig)
+		}
+	}
+	if c.sigCh != nil {
+		signal.Notify(c.sigCh, sigs...)
+	}
+}
 
-func get() *closer {
-	gC.Do(func() { gC.reinit(false) })
-	return &gC
+// RemoveSignal stops c from handling sigs, they get their default behavior back unless something else handles them,
+// the other signals stay handled without interruption.
+func (c *Closer) RemoveSignal(sigs ...os.Signal) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	var keep []os.Signal
+	for _, sig := range c.signals {
+		if !hasSignal(sigs, sig) {
+			keep = append(keep, sig)
+		}
+	}
+	c.signals = keep
+	for _, sig := range sigs {
+		delete(c.actions, sig)
+	}
+	if c.sigCh != nil {
+		c.rearm()
+	}
 }
 
-// SetSignals intalizes the global closer with the provided signals,
+// SetSignals re-arms c with the provided signals,
 // if len(signals) == 0, it uses the default signals.
-// If SetSignals is never called, it will
-func SetSignals(signals ...os.Signal) {
-	gC.reinit(true, signals...)
+func (c *Closer) SetSignals(signals ...os.Signal) {
+	c.reinit(true, signals...)
 }
 
 // Defer ensures all the functions passed are executed in a LIFO order.
-// Init(DefaultSignals) will be automatically called if the user didn't manually call it.
-// fns can be either func(), func() error or an io.Closer.
+// fns can be either func(), func() error, func(context.Context) error, func(os.Signal) error,
+// an io.Closer or an interface{ Wait() } like *sync.WaitGroup, values implementing both Close and Wait are closed.
+// context.CancelFunc is supported as well, and a context.CancelCauseFunc is called with ErrShutdown.
+// values with a Close(context.Context) error method, like gRPC style stoppers, are closed with the shutdown context,
+// e.g. a wrapper type whose Close takes a context is never treated as a plain io.Closer.
+// func() (string, error) funcs return a short summary of what they did, which is passed to OnClose.
+// context-aware funcs are passed the shutdown context, which is only bound by CleanupTimeout.
+// func(os.Signal) error funcs are passed the caught signal when run by the signal handler,
+// and nil when run by Exit, Close or the returned func.
+// func(Reason) error funcs are passed the reason of the cleanup, or the zero Reason when run by the returned func.
+// Every registered func is attempted exactly once, even if earlier ones panic or call runtime.Goexit.
+// returns a func() that triggers all the passed funcs, and only them.
+func (c *Closer) Defer(fns ...interface{}) func() {
+	return c.deferFuncs(fns...).Run
+}
+
+// DeferE is like Defer, except the returned func reports the errors of fns joined with errors.Join,
+// and returns ErrAlreadyRan if they already ran.
+func (c *Closer) DeferE(fns ...interface{}) func() error {
+	return c.deferFuncs(fns...).RunE
+}
+
+// DeferGroup registers fns to run concurrently with the other funcs of the same group,
+// groups run one after the other starting with the highest one, plain Defer funcs are part of group 0
+// and run in a LIFO order after the concurrent funcs of that group.
 // returns a func() that triggers all the passed funcs.
-// example:
-// 	defer closer.Defer(mux.Unlock, f.Close)()
-func Defer(fns ...interface{}) func() {
-	return get().deferFuncs(fns...)
+func (c *Closer) DeferGroup(group int, fns ...interface{}) func() {
+	return c.add(closerFunc{group: group, concurrent: true}, false, fns...).Run
 }
 
-// Exit calls all the defered funcs and calls os.Exit
-// if code == -1, then its set to ExitCodeErr or ExitCodeOk depending on if there were any errors returned.
-func Exit(code int) {
-	c := get()
-	c.Lock()
-	erred := c.closers.cleanup()
-	c.Unlock()
-	if code != -1 {
-		os.Exit(code)
-	}
-	if erred {
-		os.Exit(ExitCodeErr)
+// DeferP registers fns with the given priority, funcs run from the highest priority to the lowest,
+// in a LIFO order among the same priority, plain Defer funcs have a priority of 0.
+// priorities are the same as groups, the concurrent funcs of a DeferGroup run before the DeferP funcs of the same level.
+func (c *Closer) DeferP(priority int, fns ...interface{}) func() {
+	return c.add(closerFunc{group: priority}, false, fns...).Run
+}
+
+// InitPhase is a teardown band for DeferInit, see PhaseInfra, PhaseApp and PhaseUI.
+type InitPhase int
+
+const (
+	// PhaseInfra is for the infrastructure, like databases and loggers, it's torn down last.
+	PhaseInfra InitPhase = iota - 1
+	// PhaseApp is for the application logic, it's the phase of all the funcs not registered with DeferInit.
+	PhaseApp
+	// PhaseUI is for the user facing parts, like servers and listeners, it's torn down first.
+	PhaseUI
+)
+
+// DeferInit registers fns in the given phase, meant for the Defer calls in init funcs, whose order depends on the imports:
+// the phases are torn down from PhaseUI to PhaseInfra whatever the registration order, plain Defer funcs are part of PhaseApp.
+// Within a phase, the funcs run in the usual order, groups and priorities included.
+func (c *Closer) DeferInit(phase InitPhase, fns ...interface{}) func() {
+	return c.add(closerFunc{phase: phase}, false, fns...).Run
+}
+
+// DeferIf is like Defer, except fns are skipped if cond returns false.
+// cond is evaluated lazily, when the first of fns is about to run during the cleanup or through the returned func,
+// not when registering them, and only once for all of fns.
+func (c *Closer) DeferIf(cond func() bool, fns ...interface{}) func() {
+	var (
+		once sync.Once
+		ok   bool
+	)
+	when := func() bool {
+		once.Do(func() { ok = cond() })
+		return ok
+	}
+	return c.add(closerFunc{when: when}, false, fns...).Run
+}
+
+// DeferClean is like Defer, except fns only run when the stack of c is drained by Exit or Close, not by a signal,
+// e.g. to write a clean shutdown marker. They are dropped when a signal triggers the cleanup.
+func (c *Closer) DeferClean(fns ...interface{}) func() {
+	return c.add(closerFunc{on: onClean}, false, fns...).Run
+}
+
+// DeferSignal is like Defer, except fns only run when the stack of c is drained by the signal handler,
+// they are dropped by Exit and Close.
+func (c *Closer) DeferSignal(fns ...interface{}) func() {
+	return c.add(closerFunc{on: onSignal}, false, fns...).Run
+}
+
+// DeferTagged is like Defer, except fns are tagged with tag, so they can be run on their own with CloseTag.
+func (c *Closer) DeferTagged(tag string, fns ...interface{}) func() {
+	return c.add(closerFunc{tag: tag}, false, fns...).Run
+}
+
+// CloseTag runs the pending funcs of c tagged with tag in a LIFO order, leaving the rest registered,
+// it returns their errors joined with errors.Join, or nil.
+func (c *Closer) CloseTag(tag string) error {
+	c.mux.Lock()
+	var cfs closerFuncs
+	for _, cf := range c.closers {
+		if cf.fn != nil && cf.tag == tag {
+			cfs = append(cfs, cf)
+		}
+	}
+	c.mux.Unlock()
+	if len(cfs) == 0 {
+		return nil
+	}
+	return c.runNow(cfs)
+}
+
+// DeferOnce is like Defer, except fns are only registered the first time key is used with c,
+// later calls return a no-op func.
+func (c *Closer) DeferOnce(key string, fns ...interface{}) func() {
+	c.mux.Lock()
+	_, seen := c.onceKeys[key]
+	if !seen {
+		if c.onceKeys == nil {
+			c.onceKeys = make(map[string]struct{})
+		}
+		c.onceKeys[key] = struct{}{}
+	}
+	c.mux.Unlock()
+	if seen {
+		return func() {}
+	}
+	return c.deferFuncs(fns...).Run
+}
+
+// DeferFirst is like Defer, except fns are put at the bottom of the stack,
+// so they run after all the funcs that are already registered or will be registered later, even with Order = FIFO.
+func (c *Closer) DeferFirst(fns ...interface{}) func() {
+	return c.add(closerFunc{pinned: true}, true, fns...).Run
+}
+
+// DeferNamed is like Defer, except fns are labeled with name, which is passed to OnErrorDetailed and listed by Registered.
+func (c *Closer) DeferNamed(name string, fns ...interface{}) func() {
+	return c.add(closerFunc{name: name}, false, fns...).Run
+}
+
+// Events returns a channel that receives a CloseEvent every time one of the defered funcs of c returns,
+// it is closed once the stack of c is drained, a channel returned while the cleanup runs still receives its remaining events.
+// Events are queued, so a slow reader doesn't block the cleanup, every call returns a new channel.
+func (c *Closer) Events() <-chan CloseEvent {
+	c.evMux.Lock()
+	defer c.evMux.Unlock()
+	s := newEventSub()
+	if c.evDone {
+		s.close()
 	} else {
-		os.Exit(ExitCodeOk)
+		c.evSubs = append(c.evSubs, s)
+	}
+	return s.out
+}
+
+// Flush blocks until the errors queued with AsyncOnError were delivered and the events emitted by c
+// were received from its Events channels, so main can call it before exiting, or until ctx is done,
+// in which case it returns ctx.Err().
+// The signal handler and Exit already wait for the queued errors, but not for the events.
+func (c *Closer) Flush(ctx context.Context) error {
+	if err := asyncErrs.flushContext(ctx); err != nil {
+		return err
+	}
+	return c.flushEvents(ctx)
+}
+
+// Len returns the number of the funcs registered with c that didn't run yet, it doesn't lock c.
+func (c *Closer) Len() int {
+	return int(atomic.LoadInt32(&c.live))
+}
+
+// Registered returns the names of the pending funcs of c in the order they would be executed,
+// unnamed funcs are listed as "#<index>".
+// Called during a cleanup, e.g. to log what's left when it's stuck, it lists the funcs that didn't start yet.
+func (c *Closer) Registered() []string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	names := make([]string, 0, len(c.closers))
+	bs, _ := c.closers.active().batches() // funcs that already ran are only compacted once the drain is done
+	for _, b := range bs {
+		for _, cf := range b {
+			names = append(names, cf.label())
+		}
+	}
+	return names
+}
+
+// DeferHandle is like Defer, except it returns a *Handle that can also cancel the registration.
+func (c *Closer) DeferHandle(fns ...interface{}) *Handle {
+	return c.deferFuncs(fns...)
+}
+
+// DeferAfter is like DeferHandle, except fns only run once the funcs of dep did, regardless of their groups,
+// funcs without dependencies keep their usual order. See (*Handle).After.
+func (c *Closer) DeferAfter(dep *Handle, fns ...interface{}) *Handle {
+	return c.deferFuncs(fns...).After(dep)
+}
+
+// PlanEntry describes a pending func, as returned by Plan.
+type PlanEntry struct {
+	Index      int       // registration index
+	Name       string    // the name passed to DeferNamed, if any
+	Phase      InitPhase // the phase passed to DeferInit, PhaseApp for the other funcs
+	Group      int       // the group or priority
+	Concurrent bool      // whether it runs concurrently with the other funcs of its group
+	Type       string    // the type of the registered value, e.g. "func() error" or "*os.File"
+	Tag        string    // the tag passed to DeferTagged, if any
+	CleanOnly  bool      // registered with DeferClean, a signal cleanup skips it
+	SignalOnly bool      // registered with DeferSignal, Exit and Close skip it
+}
+
+// Plan returns the pending funcs of c in the order a cleanup would run them, without running anything.
+// It lists the funcs of every trigger, a cleanup only runs the ones whose CleanOnly or SignalOnly allow it.
+func (c *Closer) Plan() []PlanEntry {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entries := make([]PlanEntry, 0, len(c.closers))
+	bs, _ := c.closers.active().batches()
+	for _, b := range bs {
+		for _, cf := range b {
+			entries = append(entries, PlanEntry{cf.index, cf.name, cf.phase, cf.group, cf.concurrent, cf.typ, cf.tag, cf.on == onClean, cf.on == onSignal})
+		}
+	}
+	return entries
+}
+
+// Context returns a context that is cancelled as soon as c catches a signal, before any of the defered funcs run.
+// Signals caught while a goroutine is blocked in Wait don't cancel it.
+func (c *Closer) Context() context.Context {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.ctx
+}
+
+// Reset drops all the pending funcs of c without running them and makes c usable again after it was drained,
+// including a fresh Context if the previous one was cancelled.
+// It is meant for tests and unusual re-initialization scenarios.
+func (c *Closer) Reset() {
+	c.mux.Lock()
+	for _, cf := range c.closers {
+		c.take(cf)
+	}
+	c.closers = nil
+	c.onceKeys = nil
+	drained := c.drained
+	if drained {
+		c.drainDone = make(chan struct{})
+	}
+	c.drained, c.drainErrs = false, nil
+	atomic.StoreInt32(&c.clean, 0)
+	if c.ctx.Err() != nil {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+	}
+	c.mux.Unlock()
+	if drained {
+		c.evMux.Lock()
+		c.evDone = false
+		c.evMux.Unlock()
+	}
+	if drained && c.shared {
+		remember(c)
+	}
+}
+
+// OnReload registers fn to be called when c catches SIGHUP, errors are reported like the defered funcs' errors.
+// On windows there is no SIGHUP, so reload handlers are never called.
+// Handlers run in the order they were registered, if one of them fails the reload is aborted:
+// the remaining handlers are skipped and c keeps running, it's up to the handlers to keep their previous state.
+// Once at least one reload handler is registered, SIGHUP no longer triggers the cleanup and exit,
+// it is also handled even if it isn't part of the signals c was armed with.
+func (c *Closer) OnReload(fn func() error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.reloaders = append(c.reloaders, fn)
+	if c.sigCh != nil && reloadSignal != nil {
+		signal.Notify(c.sigCh, reloadSignal)
+	}
+}
+
+// Hold makes c drop the signals it catches until the returned func is called,
+// signals caught in between are not queued, so releasing doesn't cause a delayed shutdown.
+// The signals stay registered with signal.Notify while held, otherwise they'd get their default
+// behavior, which for SIGINT and SIGTERM is terminating the process.
+// Holds nest, signals are only handled again once every returned func was called.
+func (c *Closer) Hold() (release func()) {
+	var once sync.Once
+	c.mux.Lock()
+	c.held++
+	c.mux.Unlock()
+	return func() {
+		once.Do(func() {
+			c.mux.Lock()
+			c.held--
+			c.mux.Unlock()
+		})
+	}
+}
+
+// Wait blocks until c catches a signal and returns it.
+// While at least one goroutine is blocked in Wait, caught signals are handed to it instead of
+// running the defered funcs and exiting, it is up to the caller to shutdown after that.
+func (c *Closer) Wait() os.Signal {
+	ch := make(chan os.Signal, 1)
+	c.mux.Lock()
+	c.waiters = append(c.waiters, ch)
+	c.mux.Unlock()
+	return <-ch
+}
+
+// WaitContext is like Wait, except it also returns once ctx is done, with a nil signal and ctx.Err(),
+// in which case it stops waiting, so later signals go through the usual cleanup again.
+func (c *Closer) WaitContext(ctx context.Context) (os.Signal, error) {
+	ch := make(chan os.Signal, 1)
+	c.mux.Lock()
+	c.waiters = append(c.waiters, ch)
+	c.mux.Unlock()
+	select {
+	case sig := <-ch:
+		return sig, nil
+	case <-ctx.Done():
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for i, w := range c.waiters {
+		if w == ch {
+			c.waiters = append(c.waiters[:i:i], c.waiters[i+1:]...)
+			return nil, ctx.Err()
+		}
+	}
+	// the signal was handed over while ctx was done
+	return <-ch, nil
+}
+
+// SimulateSignal delivers sig to the signal handler of c as if the process received it,
+// it goes through Hold, OnReload, Wait and Notify like a real signal, but doesn't have to be one of the signals c handles.
+// It's meant for testing shutdown hooks in-process, so ExitFunc should be replaced, or the process exits.
+// It waits for room in the signal buffer of c, sig is dropped if Stop is called concurrently.
+func (c *Closer) SimulateSignal(sig os.Signal) {
+	c.arm()
+	for {
+		c.mux.Lock()
+		if c.sigCh == nil {
+			c.mux.Unlock()
+			return
+		}
+		select { // under the lock, so Stop can't close sigCh in between
+		case c.sigCh <- sig:
+			c.mux.Unlock()
+			return
+		default:
+		}
+		c.mux.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// SignalChan returns a new channel that gets every signal c catches, as soon as it's caught,
+// whatever c does with it afterwards, including the reload, held and ignored signals, see SetSignalAction.
+// It doesn't change how c handles them. The channel is buffered, once its buffer is full
+// the signals are dropped for it rather than blocking c, so not reading it is harmless.
+func (c *Closer) SignalChan() <-chan os.Signal {
+	ch := make(chan os.Signal, 16)
+	c.mux.Lock()
+	c.observers = append(c.observers, ch)
+	c.mux.Unlock()
+	c.arm()
+	return ch
+}
+
+// Notify relays the signals that trigger the cleanup of c to ch, right before the defered funcs start running.
+// like signal.Notify, c doesn't block sending to ch, so it should be buffered.
+func (c *Closer) Notify(ch chan<- os.Signal) {
+	c.mux.Lock()
+	c.notify = append(c.notify, ch)
+	c.mux.Unlock()
+}
+
+// DeferWithTimeout is like Defer, except waiting for each of fns is abandoned after d,
+// in which case a timeout error is reported.
+// context-aware funcs are passed a context with that deadline, the rest are run in their own goroutine,
+// note that if such a func never returns its goroutine is leaked.
+func (c *Closer) DeferWithTimeout(d time.Duration, fns ...interface{}) func() {
+	wfns := make([]interface{}, len(fns))
+	for i, fn := range fns {
+		wfns[i] = withTimeout(d, fn)
+	}
+	return c.deferFuncs(wfns...).Run
+}
+
+// DeferContext registers fn to be called with its own context, derived from the cleanup context,
+// so it is cancelled once CleanupTimeout is exceeded, and once fn returns.
+// Without CleanupTimeout, or when triggered by the returned func, the context is never done while fn runs.
+func (c *Closer) DeferContext(fn func(context.Context) error) func() {
+	return c.deferFuncs(func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		return fn(ctx)
+	}).Run
+}
+
+// DeferFlushClose registers w to be flushed then closed, like a *bufio.Writer wrapping a file or a *gzip.Writer,
+// Close is called even if Flush fails, and both errors are reported together.
+func (c *Closer) DeferFlushClose(w interface {
+	Flush() error
+	Close() error
+}) func() {
+	return c.deferFuncs(func() error {
+		var errs []error
+		if err := w.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("flush: %w", err))
+		}
+		if err := closeErr(w.Close()); err != nil {
+			errs = append(errs, fmt.Errorf("close: %w", err))
+		}
+		return joinErrors(errs)
+	}).Run
+}
+
+// DeferRetry registers fn to be called up to attempts times until it succeeds, waiting backoff between the attempts,
+// fn is called at least once, only the last error is reported. Retrying stops early once the cleanup context is done, see CleanupTimeout.
+func (c *Closer) DeferRetry(attempts int, backoff time.Duration, fn func() error) func() {
+	return c.deferFuncs(func(ctx context.Context) (err error) {
+		for i := 0; i < attempts || i == 0; i++ {
+			if i > 0 {
+				t := time.NewTimer(backoff)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return fmt.Errorf("closer: gave up after %d attempts: %w", i, err)
+				case <-t.C:
+				}
+			}
+			if err = fn(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}).Run
+}
+
+// DeferToggle registers fn like Defer, for components that start and stop repeatedly:
+// cancel removes fn from c without running it, like (*Handle).Cancel,
+// and rearm registers it again, on top of the stack, if it was cancelled or already ran, it's a no-op otherwise.
+func (c *Closer) DeferToggle(fn func() error) (cancel, rearm func()) {
+	var mux sync.Mutex
+	h := c.deferFuncs(fn)
+	cancel = func() {
+		mux.Lock()
+		defer mux.Unlock()
+		h.Cancel()
+	}
+	rearm = func() {
+		mux.Lock()
+		defer mux.Unlock()
+		c.mux.Lock()
+		pending := len(h.cfs.active()) > 0
+		c.mux.Unlock()
+		if !pending {
+			h = c.deferFuncs(fn)
+		}
+	}
+	return
+}
+
+// DeferSafe registers primary, with fallback as a degraded path: if primary fails or panics,
+// its error is logged and reported on its own, then fallback runs and its result is the func's result.
+// The panics of primary are always recovered, regardless of RecoverPanics.
+func (c *Closer) DeferSafe(primary, fallback func() error) func() {
+	return c.deferFuncs(func() error {
+		err := func() (err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					err = &PanicError{Value: p, Stack: debug.Stack()}
+				}
+			}()
+			return primary()
+		}()
+		if err == nil {
+			return nil
+		}
+		c.logf("closer: %v, running the fallback", err)
+		reportError(nil, fmt.Errorf("closer: primary failed: %w", err))
+		return fallback()
+	}).Run
+}
+
+// Barrier registers a func that blocks the cleanup until the returned func was called n times,
+// so the funcs registered before it only run once all n participants reached a safe point.
+// Calls past the n-th are no-ops. A missing participant makes it wait for the cleanup context,
+// once it's done the barrier fails and the cleanup goes on, see CleanupTimeout.
+// With Order = FIFO it still runs before the funcs registered before it, which keep their order.
+func (c *Closer) Barrier(n int) func() {
+	left, ready := int32(n), make(chan struct{})
+	if n <= 0 {
+		close(ready)
+	}
+	c.add(closerFunc{pinned: true}, false, func(ctx context.Context) error {
+		select {
+		case <-ready:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("closer: barrier: %d of %d participants not ready: %w", atomic.LoadInt32(&left), n, ctx.Err())
+		}
+	})
+	return func() {
+		if atomic.AddInt32(&left, -1) == 0 {
+			close(ready)
+		}
+	}
+}
+
+// DeferDrain registers a three phase shutdown, stop is called first to stop accepting new work,
+// then drain is called with the shutdown context to wait for the in-flight work, then close releases the resources.
+// Any of them can be nil, errors from every phase are reported together and don't stop the next phases.
+func (c *Closer) DeferDrain(stop func(), drain func(context.Context) error, close func() error) func() {
+	return c.deferFuncs(func(ctx context.Context) error {
+		var errs []error
+		if stop != nil {
+			stop()
+		}
+		if drain != nil {
+			if err := drain(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("drain: %w", err))
+			}
+		}
+		if close != nil {
+			if err := close(); err != nil {
+				errs = append(errs, fmt.Errorf("close: %w", err))
+			}
+		}
+		return joinErrors(errs)
+	}).Run
+}
+
+// Exit calls all the defered funcs of c and calls ExitFunc
+// if code == -1, then its set to ExitCodeErr or ExitCodeOk depending on if there were any errors returned,
+// or to the value returned by ExitCodeFunc if it's set.
+func (c *Closer) Exit(code int) {
+	errored, stop := true, c.watchdog()
+	defer func() { // deferred so it still exits if a func calls runtime.Goexit
+		stop()
+		if code == -1 {
+			code = c.exitCode(nil, errored)
+		}
+		c.exit(code)
+	}()
+	errored = len(c.cleanup(manual)) > 0
+}
+
+// ExitErr is like Exit(-1) for a fatal error, err is reported to OnFatal, or OnError if it's nil,
+// then the defered funcs run with err as the Err of their Reason, see LastReason,
+// and ExitFunc is called with the error exit code, whether they failed or not.
+// 	if err != nil {
+// 		c.ExitErr(err)
+// 	}
+func (c *Closer) ExitErr(err error) {
+	if OnFatal != nil {
+		OnFatal(err)
+	} else {
+		reportError(nil, err)
+	}
+	stop := c.watchdog()
+	defer func() {
+		stop()
+		c.exit(c.exitCode(nil, true))
+	}()
+	c.cleanup(Reason{Err: err})
+}
+
+// Run calls fn while c handles signals, once fn returns, it calls all the defered funcs of c
+// and returns the exit code to use, it doesn't call ExitFunc itself, unless a signal is caught.
+// A non-nil error returned by fn is reported like the defered funcs' errors.
+// example:
+// 	func main() { os.Exit(c.Run(realMain)) }
+func (c *Closer) Run(fn func() error) int {
+	err := fn()
+	if err != nil {
+		reportError(nil, err)
+	}
+	errs := c.cleanup(Reason{Err: err, Manual: err == nil})
+	return c.exitCode(nil, err != nil || len(errs) > 0)
+}
+
+// Close calls all the defered funcs of c in a LIFO order without calling os.Exit,
+// it returns all the errors returned by them joined with errors.Join, the error itself if only one failed, or nil.
+//
+// The stack of c is drained at most once, whether by Close, Exit or the signal handler,
+// later calls don't run anything and return the result of the first one.
+// funcs defered after that only run through their own trigger func.
+// The defered funcs may register new ones while running, those run in the same drain,
+// after the funcs that were pending when it started.
+func (c *Closer) Close() error {
+	return joinErrors(c.cleanup(manual))
+}
+
+// Shutting reports whether c caught a signal or started draining through Exit or Close, until Reset is called.
+// It's set before any of the defered funcs run.
+func (c *Closer) Shutting() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.drained || c.ctx.Err() != nil
+}
+
+// HandleCrash is meant to be defered at the top of main and of goroutines,
+// if the goroutine panics it reports the panic as a *PanicError, runs the defered funcs of c,
+// then exits with the error exit code, or panics again if RepanicOnCrash is set.
+// It only covers the goroutines it is explicitly defered in.
+// 	defer c.HandleCrash()
+func (c *Closer) HandleCrash() {
+	if p := recover(); p != nil {
+		c.crash(p)
+	}
+}
+
+func (c *Closer) crash(p interface{}) {
+	c.logf("closer: crashed: %v", p)
+	err := &PanicError{Value: p, Stack: debug.Stack()}
+	reportError(nil, err)
+	c.cleanup(Reason{Err: err})
+	if RepanicOnCrash {
+		panic(p)
+	}
+	c.exit(c.exitCode(nil, true))
+}
+
+// LastErrored reports whether the last time the stack of c was drained, by the signal handler, Exit or Close,
+// any of the funcs failed, it's false if c was never drained.
+func (c *Closer) LastErrored() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.lastErrored
+}
+
+// LastSignal returns the signal that triggered the last drain of the stack of c,
+// it's nil if it was drained by Exit or Close, or wasn't drained yet.
+// It's set before any of the defered funcs run, so they can use it.
+func (c *Closer) LastSignal() os.Signal {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.lastSig
+}
+
+// LastReason returns the reason of the last drain of the stack of c, like LastSignal,
+// it's the zero Reason if c wasn't drained yet.
+func (c *Closer) LastReason() Reason {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.lastReason
+}
+
+// Done returns a channel that is closed once the stack of c is drained, by the signal handler, Exit or Close.
+// On the signal and Exit paths it's closed right before ExitFunc is called,
+// so there's only a tiny window to act on it before the process exits.
+// After Reset, Done returns a new channel.
+func (c *Closer) Done() <-chan struct{} {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.drainDone
+}
+
+// AtExit returns a func that drains the stack of c like Close, meant to be defered in main,
+// so the defered funcs also run when main returns normally:
+// 	defer c.AtExit()()
+// errors are reported through OnError, and since the stack is drained at most once,
+// it doesn't run anything again if a signal, Exit or Close already did.
+func (c *Closer) AtExit() func() {
+	return func() { c.Close() }
+}
+
+// CloseCtx is like Close, except it stops starting new funcs once ctx is done,
+// the skipped funcs are reported as an error wrapping ctx.Err().
+// funcs that are already running aren't interrupted, context-aware funcs get a context derived from ctx.
+func (c *Closer) CloseCtx(ctx context.Context) error {
+	errs, _ := c.drain(ctx, manual, nil)
+	return joinErrors(errs)
+}
+
+// CloseReport is like Close, except it also returns a Report of the cleanup,
+// which is empty if the stack of c was already drained.
+func (c *Closer) CloseReport() (Report, error) {
+	var rep Report
+	errs, _ := c.drain(context.Background(), manual, &rep)
+	return rep, joinErrors(errs)
+}
+
+// Reason describes why a cleanup is happening, it's passed to the func(Reason) error closers.
+type Reason struct {
+	Signal os.Signal // the caught signal, if the cleanup was triggered by one
+	Err    error     // the fatal error, e.g. the *PanicError caught by HandleCrash or the error returned to Run
+	Manual bool      // whether it was triggered by Close, Exit or Run without an error
+}
+
+var manual = Reason{Manual: true}
+
+// cleanup drains the stack of c for the given reason.
+func (c *Closer) cleanup(why Reason) []error {
+	errs, _ := c.drain(context.Background(), why, nil)
+	return errs
+}
+
+// drain runs all the pending funcs the first time it's called and caches the errors they returned,
+// later calls, including concurrent ones from other triggers, wait for the first one to finish,
+// then return the cached errors and first == false without running anything.
+// if rep isn't nil, it is filled for the first call.
+// the remaining funcs are skipped once parent is done.
+func (c *Closer) drain(parent context.Context, why Reason, rep *Report) (errs []error, first bool) {
+	if atomic.LoadInt32(&c.clean) == 1 {
+		return nil, false // fast path, c was already drained without errors, don't lock
+	}
+	c.mux.Lock()
+	if c.drained {
+		done := c.drainDone
+		c.mux.Unlock()
+		<-done
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		return c.drainErrs, false
+	}
+	c.drained = true
+	c.lastSig, c.lastReason = why.Signal, why
+	done := c.drainDone
+	c.mux.Unlock()
+
+	if atomic.LoadInt32(&c.live) == 0 && OnBeforeCleanup == nil && OnAfterCleanup == nil && JSONLog == nil {
+		c.finishDrain(nil, done) // fast path, there's nothing to run or report
+		return nil, true
+	}
+
+	ctx, cancel := c.shutdownContext(parent)
+	defer cancel()
+	r := c.newRun(context.WithValue(ctx, reasonKey{}, why))
+	r.report = rep
+	start := time.Now()
+	stopWarn := c.graceWarning()
+	defer func() { // deferred so it still happens if a func calls runtime.Goexit
+		stopWarn()
+		if rep != nil {
+			rep.Duration = time.Since(start)
+		}
+		c.finishDrain(r.errs, done)
+	}()
+	// funcs registered by the running funcs are picked up by the next call to next and run in the same drain.
+	r.run(func() closerFuncs {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		return c.drop(c.closers.active(), why.Signal)
+	})
+	return r.errs, true
+}
+
+// finishDrain caches the result of a drain, closes done and the Events channels and forgets c.
+func (c *Closer) finishDrain(errs []error, done chan struct{}) {
+	c.mux.Lock()
+	c.drainErrs = errs
+	c.lastErrored = len(errs) > 0
+	if len(errs) == 0 {
+		atomic.StoreInt32(&c.clean, 1)
+	}
+	c.closers = c.closers.pending()
+	c.mux.Unlock()
+	close(done)
+	c.closeEvents()
+	if c.shared {
+		forget(c)
+	}
+}
+
+var gC = newCloser()
+
+// get returns the global closer, arming it with the default signals on first use.
+func get() *Closer {
+	gC.arm()
+	return gC
+}
+
+// SetSignals intalizes the global closer with the provided signals,
+// if len(signals) == 0, it uses the default signals.
+// If SetSignals is never called, it will
+func SetSignals(signals ...os.Signal) {
+	gC.SetSignals(signals...)
+}
+
+var defaults = struct {
+	sync.Mutex
+	signals []os.Signal
+}{signals: defaultSignals()}
+
+// DefaultSignals returns a copy of the signals closers handle when they aren't given any.
+func DefaultSignals() []os.Signal {
+	defaults.Lock()
+	defer defaults.Unlock()
+	return append([]os.Signal(nil), defaults.signals...)
+}
+
+// SetDefaultSignals replaces the signals closers handle when they aren't given any, signals is copied.
+// note that closers that are already armed keep handling the previous ones, see SetSignals.
+func SetDefaultSignals(signals ...os.Signal) {
+	defaults.Lock()
+	defaults.signals = append([]os.Signal(nil), signals...)
+	defaults.Unlock()
+}
+
+// settings guards the package level settings that can be changed while signals are handled, see SetOnError.
+var settings sync.RWMutex
+
+// SetExitCodeOk sets ExitCodeOk, it's safe to call while a signal may be handled, unlike assigning it.
+func SetExitCodeOk(code int) {
+	settings.Lock()
+	ExitCodeOk = code
+	settings.Unlock()
+}
+
+// SetExitCodeErr sets ExitCodeErr, it's safe to call while a signal may be handled, unlike assigning it.
+func SetExitCodeErr(code int) {
+	settings.Lock()
+	ExitCodeErr = code
+	settings.Unlock()
+}
+
+// SetExitWithSignalCode sets ExitWithSignalCode, it's safe to call while a signal may be handled, unlike assigning it.
+func SetExitWithSignalCode(v bool) {
+	settings.Lock()
+	ExitWithSignalCode = v
+	settings.Unlock()
+}
+
+// SetExitCodeFunc sets ExitCodeFunc, it's safe to call while a signal may be handled, unlike assigning it.
+func SetExitCodeFunc(fn func(sig os.Signal, errored bool) int) {
+	settings.Lock()
+	ExitCodeFunc = fn
+	settings.Unlock()
+}
+
+// SetCleanupTimeout sets CleanupTimeout, it's safe to call while a signal may be handled, unlike assigning it.
+func SetCleanupTimeout(d time.Duration) {
+	settings.Lock()
+	CleanupTimeout = d
+	settings.Unlock()
+}
+
+// SetOnError sets OnError, it's safe to call while a cleanup may be running, unlike assigning it.
+func SetOnError(fn func(err error)) {
+	settings.Lock()
+	OnError = fn
+	settings.Unlock()
+}
+
+// SetOnErrorDetailed sets OnErrorDetailed, it's safe to call while a cleanup may be running, unlike assigning it.
+func SetOnErrorDetailed(fn func(index int, name string, err error)) {
+	settings.Lock()
+	OnErrorDetailed = fn
+	settings.Unlock()
+}
+
+// Defer ensures all the functions passed are executed in a LIFO order.
+// Init(DefaultSignals()) will be automatically called if the user didn't manually call it.
+// fns can be either func(), func() error, func(context.Context) error, func(os.Signal) error, func(closer.Reason) error,
+// an io.Closer or an interface{ Wait() } like *sync.WaitGroup.
+// returns a func() that triggers all the passed funcs.
+// example:
+// 	defer closer.Defer(mux.Unlock, f.Close)()
+// 	closer.Defer(srv.Shutdown)
+func Defer(fns ...interface{}) func() {
+	return get().Defer(fns...)
+}
+
+// DeferE is like Defer, except the returned func returns the errors of fns, or ErrAlreadyRan.
+// See (*Closer).DeferE.
+func DeferE(fns ...interface{}) func() error {
+	return get().DeferE(fns...)
+}
+
+// DeferGroup registers fns to run concurrently with the other funcs of the same group.
+// See (*Closer).DeferGroup.
+func DeferGroup(group int, fns ...interface{}) func() {
+	return get().DeferGroup(group, fns...)
+}
+
+// DeferP registers fns with the given priority, higher priorities run first.
+// See (*Closer).DeferP.
+func DeferP(priority int, fns ...interface{}) func() {
+	return get().DeferP(priority, fns...)
+}
+
+// DeferInit registers fns in the given teardown phase of the global closer.
+// See (*Closer).DeferInit.
+func DeferInit(phase InitPhase, fns ...interface{}) func() {
+	return get().DeferInit(phase, fns...)
+}
+
+// DeferIf is like Defer, except fns are skipped if cond returns false at cleanup time.
+// See (*Closer).DeferIf.
+func DeferIf(cond func() bool, fns ...interface{}) func() {
+	return get().DeferIf(cond, fns...)
+}
+
+// DeferClean is like Defer, except fns don't run when the cleanup is triggered by a signal.
+// See (*Closer).DeferClean.
+func DeferClean(fns ...interface{}) func() {
+	return get().DeferClean(fns...)
+}
+
+// DeferSignal is like Defer, except fns only run when the cleanup is triggered by a signal.
+// See (*Closer).DeferSignal.
+func DeferSignal(fns ...interface{}) func() {
+	return get().DeferSignal(fns...)
+}
+
+// DeferTagged is like Defer, except fns are tagged with tag, see CloseTag.
+// See (*Closer).DeferTagged.
+func DeferTagged(tag string, fns ...interface{}) func() {
+	return get().DeferTagged(tag, fns...)
+}
+
+// CloseTag runs the pending funcs tagged with tag, leaving the rest registered.
+// See (*Closer).CloseTag.
+func CloseTag(tag string) error {
+	return get().CloseTag(tag)
+}
+
+// DeferOnce is like Defer, except fns are only registered the first time key is used.
+// See (*Closer).DeferOnce.
+func DeferOnce(key string, fns ...interface{}) func() {
+	return get().DeferOnce(key, fns...)
+}
+
+// DeferFirst is like Defer, except fns run after all the other funcs, even the ones registered later.
+// See (*Closer).DeferFirst.
+func DeferFirst(fns ...interface{}) func() {
+	return get().DeferFirst(fns...)
+}
+
+// DeferNamed is like Defer, except fns are labeled with name, which is passed to OnErrorDetailed and listed by Registered.
+func DeferNamed(name string, fns ...interface{}) func() {
+	return get().DeferNamed(name, fns...)
+}
+
+// Reset drops all the pending funcs without running them and makes the global closer usable again.
+// See (*Closer).Reset.
+func Reset() {
+	gC.Reset()
+}
+
+// Events returns a channel that receives a CloseEvent every time one of the defered funcs returns.
+// See (*Closer).Events.
+func Events() <-chan CloseEvent {
+	return get().Events()
+}
+
+// Len returns the number of the registered funcs that didn't run yet.
+func Len() int {
+	return get().Len()
+}
+
+// Registered returns the names of the pending funcs in the order they would be executed.
+// See (*Closer).Registered.
+func Registered() []string {
+	return get().Registered()
+}
+
+// DeferHandle is like Defer, except it returns a *Handle that can also cancel the registration.
+func DeferHandle(fns ...interface{}) *Handle {
+	return get().DeferHandle(fns...)
+}
+
+// Plan returns the pending funcs in the order a cleanup would run them.
+// See (*Closer).Plan.
+func Plan() []PlanEntry {
+	return get().Plan()
+}
+
+// DeferAfter is like DeferHandle, except fns only run once the funcs of dep did.
+// See (*Closer).DeferAfter.
+func DeferAfter(dep *Handle, fns ...interface{}) *Handle {
+	return get().DeferAfter(dep, fns...)
+}
+
+// AddSignal makes the global closer handle sigs as well.
+// See (*Closer).AddSignal.
+func AddSignal(sigs ...os.Signal) {
+	get().AddSignal(sigs...)
+}
+
+// RemoveSignal stops the global closer from handling sigs.
+// See (*Closer).RemoveSignal.
+func RemoveSignal(sigs ...os.Signal) {
+	get().RemoveSignal(sigs...)
+}
+
+// Stop stops the global closer from handling signals until the next Defer call.
+// See (*Closer).Stop.
+func Stop() {
+	gC.Stop()
+}
+
+// Context returns a context that is cancelled as soon as a signal is caught, before any of the defered funcs run.
+func Context() context.Context {
+	return get().Context()
+}
+
+// OnReload registers fn to be called on SIGHUP instead of cleaning up and exiting.
+// See (*Closer).OnReload.
+func OnReload(fn func() error) {
+	get().OnReload(fn)
+}
+
+// Hold drops caught signals until the returned func is called.
+// See (*Closer).Hold.
+func Hold() (release func()) {
+	return get().Hold()
+}
+
+// Wait blocks until a signal is caught and returns it without running the defered funcs or exiting.
+// See (*Closer).Wait.
+func Wait() os.Signal {
+	return get().Wait()
+}
+
+// WaitContext blocks until a signal is caught or ctx is done.
+// See (*Closer).WaitContext.
+func WaitContext(ctx context.Context) (os.Signal, error) {
+	return get().WaitContext(ctx)
+}
+
+// ServeSignals runs the cleanup of the global closer on the calling goroutine once a signal is caught.
+// See (*Closer).ServeSignals.
+func ServeSignals() {
+	get().ServeSignals()
+}
+
+// SimulateSignal delivers sig to the signal handler of the global closer as if the process received it.
+// See (*Closer).SimulateSignal.
+func SimulateSignal(sig os.Signal) {
+	get().SimulateSignal(sig)
+}
+
+// Flush waits for the queued errors and the events of the global closer to be delivered.
+// See (*Closer).Flush.
+func Flush(ctx context.Context) error {
+	return get().Flush(ctx)
+}
+
+// SignalChan returns a channel that gets every signal the global closer catches.
+// See (*Closer).SignalChan.
+func SignalChan() <-chan os.Signal {
+	return get().SignalChan()
+}
+
+// Notify relays the signals that trigger the cleanup to ch.
+// See (*Closer).Notify.
+func Notify(ch chan<- os.Signal) {
+	get().Notify(ch)
+}
+
+// DeferWithTimeout is like Defer, except waiting for each of fns is abandoned after d.
+// See (*Closer).DeferWithTimeout.
+func DeferWithTimeout(d time.Duration, fns ...interface{}) func() {
+	return get().DeferWithTimeout(d, fns...)
+}
+
+// DeferContext registers fn to be called with a context that is cancelled once CleanupTimeout is exceeded.
+// See (*Closer).DeferContext.
+func DeferContext(fn func(context.Context) error) func() {
+	return get().DeferContext(fn)
+}
+
+// DeferFlushClose registers w to be flushed then closed.
+// See (*Closer).DeferFlushClose.
+func DeferFlushClose(w interface {
+	Flush() error
+	Close() error
+}) func() {
+	return get().DeferFlushClose(w)
+}
+
+// DeferRetry registers fn to be retried up to attempts times, waiting backoff between the attempts.
+// See (*Closer).DeferRetry.
+func DeferRetry(attempts int, backoff time.Duration, fn func() error) func() {
+	return get().DeferRetry(attempts, backoff, fn)
+}
+
+// DeferToggle registers fn with the global closer, returning funcs to cancel and register it again.
+// See (*Closer).DeferToggle.
+func DeferToggle(fn func() error) (cancel, rearm func()) {
+	return get().DeferToggle(fn)
+}
+
+// DeferSafe registers primary, running fallback if it fails or panics.
+// See (*Closer).DeferSafe.
+func DeferSafe(primary, fallback func() error) func() {
+	return get().DeferSafe(primary, fallback)
+}
+
+// Barrier blocks the cleanup of the global closer until the returned func was called n times.
+// See (*Closer).Barrier.
+func Barrier(n int) func() {
+	return get().Barrier(n)
+}
+
+// DeferDrain registers a three phase stop, drain, close shutdown.
+// See (*Closer).DeferDrain.
+func DeferDrain(stop func(), drain func(context.Context) error, close func() error) func() {
+	return get().DeferDrain(stop, drain, close)
+}
+
+// Exit calls all the defered funcs and calls ExitFunc
+// if code == -1, then its set to ExitCodeErr or ExitCodeOk depending on if there were any errors returned.
+func Exit(code int) {
+	get().Exit(code)
+}
+
+// ExitErr reports the fatal err, calls all the defered funcs and calls ExitFunc with the error exit code.
+// See (*Closer).ExitErr.
+func ExitErr(err error) {
+	get().ExitErr(err)
+}
+
+// Run calls fn while signals are handled, then calls all the defered funcs and returns the exit code to use.
+// example:
+// 	func main() { os.Exit(closer.Run(realMain)) }
+func Run(fn func() error) int {
+	return get().Run(fn)
+}
+
+// Close calls all the defered funcs in a LIFO order without calling os.Exit,
+// it returns all the errors returned by them joined with errors.Join, the error itself if only one failed, or nil.
+func Close() error {
+	return get().Close()
+}
+
+// Shutting reports whether a signal was caught or Exit or Close were called.
+// See (*Closer).Shutting.
+func Shutting() bool {
+	return get().Shutting()
+}
+
+// HandleCrash runs the defered funcs if the goroutine it is defered in panics, then exits.
+// See (*Closer).HandleCrash.
+func HandleCrash() {
+	if p := recover(); p != nil { // recover only works when called directly by the defered func
+		get().crash(p)
+	}
+}
+
+// LastErrored reports whether any of the defered funcs failed the last time they were drained.
+// See (*Closer).LastErrored.
+func LastErrored() bool {
+	return get().LastErrored()
+}
+
+// LastSignal returns the signal that triggered the shutdown, or nil.
+// See (*Closer).LastSignal.
+func LastSignal() os.Signal {
+	return get().LastSignal()
+}
+
+// LastReason returns the reason of the shutdown.
+// See (*Closer).LastReason.
+func LastReason() Reason {
+	return get().LastReason()
+}
+
+// Done returns a channel that is closed once the defered funcs finished running.
+// See (*Closer).Done.
+func Done() <-chan struct{} {
+	return get().Done()
+}
+
+// AtExit returns a func that runs all the defered funcs when main returns, it must be called once from main:
+// 	func main() {
+// 		defer closer.AtExit()()
+// 		...
+// 	}
+// See (*Closer).AtExit.
+func AtExit() func() {
+	return get().AtExit()
+}
+
+// CloseCtx is like Close, except it stops starting new funcs once ctx is done.
+// See (*Closer).CloseCtx.
+func CloseCtx(ctx context.Context) error {
+	return get().CloseCtx(ctx)
+}
+
+// CloseReport is like Close, except it also returns a Report of the cleanup.
+// See (*Closer).CloseReport.
+func CloseReport() (Report, error) {
+	return get().CloseReport()
+}
+
+// ConfigureFromEnv sets ExitWithSignalCode from CLOSER_EXIT_SIGNAL_CODE, parsed with strconv.ParseBool,
+// and CleanupTimeout from CLOSER_CLEANUP_TIMEOUT, parsed with time.ParseDuration, unset variables are ignored.
+// the variables that fail to parse are left unapplied and their errors are returned.
+func ConfigureFromEnv() error {
+	var errs []error
+	if v, ok := os.LookupEnv("CLOSER_EXIT_SIGNAL_CODE"); ok {
+		if b, err := strconv.ParseBool(v); err != nil {
+			errs = append(errs, fmt.Errorf("closer: CLOSER_EXIT_SIGNAL_CODE: %w", err))
+		} else {
+			SetExitWithSignalCode(b)
+		}
+	}
+	if v, ok := os.LookupEnv("CLOSER_CLEANUP_TIMEOUT"); ok {
+		if d, err := time.ParseDuration(v); err != nil {
+			errs = append(errs, fmt.Errorf("closer: CLOSER_CLEANUP_TIMEOUT: %w", err))
+		} else {
+			SetCleanupTimeout(d)
+		}
+	}
+	return joinErrors(errs)
+}
+
+var shutdownDeadline time.Time // guarded by settings
+
+// SetShutdownDeadline bounds every cleanup that starts after it's called to finish by t, like CleanupTimeout does,
+// e.g. to match the end of an orchestrator's grace period, the zero time removes it.
+// If CleanupTimeout is set as well, whichever comes first applies.
+// If t already passed when a cleanup starts, its funcs are skipped and the cleanup counts as errored.
+// It's safe to call while a signal cleanup may be starting.
+func SetShutdownDeadline(t time.Time) {
+	settings.Lock()
+	shutdownDeadline = t
+	settings.Unlock()
+}
+
+// Chain returns a func that calls all the triggers in order, like the funcs returned by Defer,
+// it can be called any number of times, since the triggers only run their funcs once.
+func Chain(triggers ...func()) func() {
+	return func() {
+		for _, fn := range triggers {
+			fn()
+		}
+	}
+}
+
+// CloseAll calls all the defered funcs of every Closer created with WithCloseAll, newest first, then the global ones,
+// closers that were already drained or stopped are skipped, the other closers created by New are left alone.
+// Unlike Close, the returned error joins the errors returned by all of them.
+func CloseAll() error {
+	instances.Lock()
+	cs := append([]*Closer{gC}, instances.list...)
+	instances.Unlock()
+
+	var errs []error
+	for i := len(cs) - 1; i > -1; i-- {
+		if cerrs, first := cs[i].drain(context.Background(), manual, nil); first {
+			errs = append(errs, cerrs...)
+		}
 	}
+	return joinErrors(errs)
 }
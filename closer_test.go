@@ -1,17 +1,37 @@
 package closer_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/OneOfOne/closer"
+	"github.com/OneOfOne/closer/closertest"
 )
 
-var testSignal = os.Getenv("TEST_SIGNAL") == "1"
+var (
+	testSignal = os.Getenv("TEST_SIGNAL") == "1"
+	testWait   = os.Getenv("TEST_WAIT") == "1"
+	testForce  = os.Getenv("TEST_FORCE") == "1"
+	testReload = os.Getenv("TEST_RELOAD") == "1"
+	testQuit   = os.Getenv("TEST_QUIT") == "1"
+)
 
 func TestCloser(t *testing.T) {
 	var vals []int
@@ -31,27 +51,1981 @@ func TestCloser(t *testing.T) {
 
 }
 
-func TestSignal(t *testing.T) {
-	if testSignal {
-		closer.ExitWithSignalCode = false
-		defer closer.Defer(func() { closer.ExitCodeErr = 55 })()
-		select {}
+func TestChain(t *testing.T) {
+	var vals []int
+	c := closer.New()
+	a := c.Defer(func() { vals = append(vals, 1) })
+	b := c.Defer(func() { vals = append(vals, 2) })
+	fn := closer.Chain(a, b)
+	fn()
+	fn()
+	if fmt.Sprint(vals) != "[1 2]" || c.Len() != 0 {
+		t.Fatalf("unexpected result: %v", vals)
 	}
-	cmd := exec.Command(os.Args[0], "-test.run=TestSignal")
-	cmd.Env = append(os.Environ(), "TEST_SIGNAL=1")
-	if err := cmd.Start(); err != nil {
+}
+
+func TestSetDefaultSignals(t *testing.T) {
+	orig := closer.DefaultSignals()
+	defer closer.SetDefaultSignals(orig...)
+
+	sigs := []os.Signal{syscall.SIGTERM}
+	closer.SetDefaultSignals(sigs...)
+	sigs[0] = syscall.SIGINT
+	if got := closer.DefaultSignals(); len(got) != 1 || got[0] != syscall.SIGTERM {
+		t.Fatalf("unexpected default signals: %v", got)
+	}
+	closer.DefaultSignals()[0] = syscall.SIGINT
+	if got := closer.DefaultSignals(); got[0] != syscall.SIGTERM {
+		t.Fatalf("unexpected default signals: %v", got)
+	}
+}
+
+func TestDeferE(t *testing.T) {
+	errFoo := errors.New("foo")
+	c := closer.New()
+	fn := c.DeferE(func() {}, func() error { return errFoo })
+	if err := fn(); !errors.Is(err, errFoo) {
+		t.Fatalf("expected %v, got %v", errFoo, err)
+	}
+	if err := fn(); err != closer.ErrAlreadyRan {
+		t.Fatalf("expected ErrAlreadyRan, got %v", err)
+	}
+	if err := c.DeferE(func() {})(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeferP(t *testing.T) {
+	add, order := closertest.Recorder()
+	c := closer.New()
+	c.DeferP(100, add("100"))
+	c.Defer(add("0"))
+	c.DeferP(-1, add("-1"))
+	c.DeferP(100, add("101"))
+	c.DeferP(50, add("50"))
+	c.Close()
+	if vals := order(); fmt.Sprint(vals) != "[101 100 50 0 -1]" {
+		t.Fatalf("unexpected order: %v", vals)
+	}
+}
+
+func TestCloseTag(t *testing.T) {
+	add, order := closertest.Recorder()
+	c := closer.New()
+	c.DeferTagged("cache", add("cache 1"))
+	c.Defer(add("db"))
+	c.DeferTagged("cache", add("cache 2"))
+	c.DeferTagged("http", add("http"))
+	if err, vals := c.CloseTag("cache"), order(); err != nil || fmt.Sprint(vals) != "[cache 2 cache 1]" || c.Len() != 2 {
+		t.Fatalf("unexpected result: %v, %v, %d", err, vals, c.Len())
+	}
+	if c.Close(); fmt.Sprint(order()[2:]) != "[http db]" {
+		t.Fatalf("unexpected result: %v", order())
+	}
+}
+
+func TestDeferGroup(t *testing.T) {
+	add, order := closertest.Recorder()
+	c := closer.New()
+	c.Defer(add("0"))
+	c.DeferGroup(1, add("1"), add("1"), add("1"))
+	c.DeferGroup(2, add("2"))
+	c.Defer(add("0"))
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if exp, vals := "[2 1 1 1 0 0]", order(); fmt.Sprint(vals) != exp {
+		t.Fatalf("expected %v, got %v", exp, vals)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	c := closer.New()
+	c.Defer(func() {})
+	c.DeferNamed("file", io.NopCloser(nil))
+	c.DeferGroup(1, func() error { return nil })
+	c.DeferSignal(func() {})
+	c.DeferTagged("db", func() {})
+	plan := c.Plan()
+	exp := []closer.PlanEntry{
+		{Index: 2, Group: 1, Concurrent: true, Type: "func() error"},
+		{Index: 4, Type: "func()", Tag: "db"},
+		{Index: 3, Type: "func()", SignalOnly: true},
+		{Index: 1, Name: "file", Type: "io.nopCloser"},
+		{Index: 0, Type: "func()"},
+	}
+	if fmt.Sprint(plan) != fmt.Sprint(exp) {
+		t.Fatalf("unexpected plan: %+v", plan)
+	}
+	if c.Close(); len(c.Plan()) != 0 {
+		t.Fatal("expected an empty plan after Close")
+	}
+
+	c = closer.New()
+	c.Defer(func() {})
+	c.Defer(func() { plan = c.Plan() })
+	if c.Close(); len(plan) != 1 || plan[0].Index != 0 {
+		t.Fatalf("expected the plan to skip the funcs that ran, got %+v", plan)
+	}
+}
+
+func TestIgnoreAlreadyClosed(t *testing.T) {
+	f, err := os.Open(os.Args[0])
+	if err != nil {
 		t.Fatal(err)
 	}
+	f.Close()
+	c := closer.New()
+	c.Defer(f)
+	if err := c.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c = closer.New()
+	c.Defer(f, func() error { return f.Close() })
+	closer.IgnoreAlreadyClosed = false
+	defer func() { closer.IgnoreAlreadyClosed = true }()
+	if err := c.Close(); len(unwrapAll(err)) != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+}
+
+// unwrapAll returns the errors joined in err.
+func unwrapAll(err error) []error {
+	if u, ok := err.(interface{ Unwrap() []error }); ok {
+		return u.Unwrap()
+	}
+	if err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+func TestJoinedErrors(t *testing.T) {
+	c := closer.New()
+	c.Defer(func() error { return io.EOF })
+	if err := c.Close(); err != io.EOF {
+		t.Fatalf("expected a single error to be returned as is, got %#v", err)
+	}
+
+	c = closer.New()
+	c.Defer(func() error { return io.EOF }, func() error { return fmt.Errorf("wrapped: %w", os.ErrClosed) })
+	if err := c.Close(); !errors.Is(err, io.EOF) || !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("expected both errors to match, got %v", err)
+	}
+}
+
+func TestDrainOnce(t *testing.T) {
+	var n int
+	c := closer.New()
+	fn := c.Defer(func() { n++ })
+	c.Close()
+	c.Close()
+	fn()
+	if n != 1 {
+		t.Fatalf("expected 1 call, got %d", n)
+	}
+}
+
+func TestConcurrentCleanup(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		var (
+			n     int32
+			exits = make(chan int, 2)
+		)
+		c := closer.New(closer.WithExitFunc(func(code int) { exits <- code }))
+		c.Defer(func() error { atomic.AddInt32(&n, 1); return io.EOF })
+		go c.Exit(-1)
+		go c.SimulateSignal(syscall.SIGTERM)
+		for j := 0; j < 2; j++ {
+			if code := <-exits; code != closer.ExitCodeErr {
+				t.Fatalf("expected both triggers to see the error, got exit code %d", code)
+			}
+		}
+		c.Stop()
+		if n != 1 {
+			t.Fatalf("expected a single execution, got %d", n)
+		}
+	}
+}
+
+func TestSetters(t *testing.T) {
+	defer func() { closer.SetExitCodeErr(1); closer.SetOnError(nil) }()
+
+	var reported int32
+	exits := make(chan int, 1)
+	c := closer.New(closer.WithExitFunc(func(code int) { exits <- code }))
+	defer c.Stop()
+	c.Defer(func() error { return io.EOF })
+	go func() {
+		closer.SetExitCodeErr(60)
+		closer.SetOnError(func(error) { atomic.AddInt32(&reported, 1) })
+		c.SimulateSignal(syscall.SIGTERM)
+	}()
+	if code := <-exits; code != 60 || atomic.LoadInt32(&reported) != 1 {
+		t.Fatalf("unexpected result: %d, %d", code, reported)
+	}
+}
+
+func TestReset(t *testing.T) {
+	var n int
+	c := closer.New()
+	c.Defer(func() { n++ })
+	c.Reset()
+	c.Close()
+	c.Defer(func() { n += 2 })
+	c.Reset()
+	c.Defer(func() { n += 3 })
+	c.Close()
+	if n != 3 {
+		t.Fatalf("expected 3, got %d", n)
+	}
+}
+
+func TestStopOnFirstError(t *testing.T) {
+	closer.StopOnFirstError = true
+	defer func() { closer.StopOnFirstError = false }()
+
+	var ran, cancelled bool
+	c := closer.New()
+	c.Defer(func() { ran = true })
+	c.DeferGroup(1, func() error { return io.EOF }, func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			cancelled = true
+		case <-time.After(time.Second):
+		}
+		return nil
+	})
+	err := c.Close()
+	if errs := unwrapAll(err); len(errs) != 2 || errs[0] != io.EOF || ran || !cancelled {
+		t.Fatalf("unexpected result: %v, %v, %v", err, ran, cancelled)
+	}
+}
+
+func TestAsyncOnError(t *testing.T) {
+	var (
+		mux      sync.Mutex
+		reported []error
+	)
+	release := make(chan struct{})
+	closer.AsyncOnError = true
+	closer.OnError = func(err error) {
+		<-release
+		mux.Lock()
+		reported = append(reported, err)
+		mux.Unlock()
+	}
+	closer.ExitFunc = func(int) {
+		mux.Lock()
+		defer mux.Unlock()
+		if len(reported) != 2 {
+			t.Errorf("expected the errors to be delivered before exiting, got %v", reported)
+		}
+	}
+	defer func() { closer.AsyncOnError, closer.OnError, closer.ExitFunc = false, nil, os.Exit }()
+
+	c := closer.New()
+	c.Defer(func() error { return io.EOF }, func() error { return io.ErrUnexpectedEOF })
 	go func() {
-		time.Sleep(time.Millisecond * 10)
-		cmd.Process.Signal(syscall.SIGTERM)
+		time.Sleep(10 * time.Millisecond)
+		close(release)
 	}()
+	c.Exit(0)
+}
 
-	if err := cmd.Wait(); err != nil {
-		if !strings.Contains(err.Error(), "55") {
-			t.Fatalf("unexpected exit code: %v", err)
+func TestAsyncOnErrorConcurrentFlush(t *testing.T) {
+	var reported int32
+	closer.AsyncOnError = true
+	closer.OnError = func(error) { atomic.AddInt32(&reported, 1) }
+	defer func() { closer.AsyncOnError, closer.OnError = false, nil }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c := closer.New()
+				c.Defer(func() error { return io.EOF })
+				c.Close()
+			}
+		}()
+		go func() { // flushes of other closers wait while errors keep being queued
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				closer.New().Flush(context.Background())
+			}
+		}()
+	}
+	wg.Wait()
+	if err := closer.New().Flush(context.Background()); err != nil || atomic.LoadInt32(&reported) != 400 {
+		t.Fatalf("unexpected result: %v, %d", err, reported)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c := closer.New()
+	events := c.Events()
+	c.Defer(func() {}, func() {})
+	c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected Flush to wait for the events, got %v", err)
+	}
+	go func() {
+		for range events {
 		}
-	} else {
-		t.Fatal("process exited without error")
+	}()
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnSkipped(t *testing.T) {
+	var skipped []string
+	closer.OnSkipped = func(name string, reason error) {
+		if errors.Is(reason, context.DeadlineExceeded) {
+			skipped = append(skipped, name)
+		}
+	}
+	defer func() { closer.OnSkipped = nil }()
+
+	c := closer.New(closer.WithTimeout(10 * time.Millisecond))
+	c.DeferNamed("db flush", func() {})
+	c.DeferNamed("cache", func() {})
+	c.Defer(func() { time.Sleep(20 * time.Millisecond) })
+	c.Close()
+	if exp := "[cache db flush]"; fmt.Sprint(skipped) != exp {
+		t.Fatalf("expected %v, got %v", exp, skipped)
+	}
+
+	skipped = nil
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	c = closer.New()
+	c.DeferNamed("db flush", func() {})
+	c.DeferNamed("cache", func() {})
+	if err := c.CloseCtx(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := "[cache db flush]"; fmt.Sprint(skipped) != exp {
+		t.Fatalf("expected %v with an expired context, got %v", exp, skipped)
+	}
+
+	skipped = nil
+	c = closer.New(closer.WithTimeout(10 * time.Millisecond))
+	c.Defer(func() {
+		time.Sleep(20 * time.Millisecond)
+		c.DeferNamed("late", func() {})
+	})
+	c.Close()
+	if exp := "[late]"; fmt.Sprint(skipped) != exp {
+		t.Fatalf("expected %v between passes, got %v", exp, skipped)
+	}
+}
+
+func TestMaxClosers(t *testing.T) {
+	var reported error
+	closer.MaxClosers, closer.OnError = 2, func(err error) { reported = err }
+	defer func() { closer.MaxClosers, closer.OnError = 0, nil }()
+
+	var n int
+	c := closer.New()
+	c.Defer(func() { n++ })
+	run := c.DeferE(func() { n++ }, func() { n++ })
+	if !errors.Is(reported, closer.ErrTooManyClosers) || !errors.Is(run(), closer.ErrTooManyClosers) {
+		t.Fatalf("expected the registration to be dropped, got %v", reported)
+	}
+	if c.Defer(func() { n++ }); c.Len() != 2 {
+		t.Fatalf("expected 2 pending funcs, got %d", c.Len())
+	}
+	if c.Close(); n != 2 {
+		t.Fatalf("expected 2 funcs to run, got %d", n)
+	}
+}
+
+func TestMaxConcurrentClosers(t *testing.T) {
+	closer.MaxConcurrentClosers = 2
+	defer func() { closer.MaxConcurrentClosers = 0 }()
+
+	var (
+		mux       sync.Mutex
+		cur, peak int
+	)
+	fn := func() {
+		mux.Lock()
+		if cur++; cur > peak {
+			peak = cur
+		}
+		mux.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mux.Lock()
+		cur--
+		mux.Unlock()
+	}
+	c := closer.New()
+	c.DeferGroup(1, fn, fn, fn, fn, fn)
+	c.Close()
+	if peak != 2 {
+		t.Fatalf("expected at most 2 concurrent funcs, got %d", peak)
+	}
+}
+
+func TestOnErrorDetailed(t *testing.T) {
+	var got []string
+	closer.OnErrorDetailed = func(idx int, name string, err error) {
+		got = append(got, fmt.Sprintf("%d:%s:%v", idx, name, err))
+	}
+	defer func() { closer.OnErrorDetailed = nil }()
+
+	c := closer.New()
+	c.Defer(func() error { return errors.New("a") })
+	c.DeferNamed("db", func() error { return errors.New("b") })
+	c.Close()
+
+	if exp := "[1:db:b 0::a]"; fmt.Sprint(got) != exp {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	c := closer.New()
+	c.DeferNamed("db", func() {})
+	c.Defer(func() {})
+	done := c.DeferNamed("cache", func() {})
+
+	if exp := "[cache #1 db]"; fmt.Sprint(c.Registered()) != exp {
+		t.Fatalf("expected %v, got %v", exp, c.Registered())
+	}
+	done()
+	if exp := "[#1 db]"; fmt.Sprint(c.Registered()) != exp {
+		t.Fatalf("expected %v, got %v", exp, c.Registered())
+	}
+	if c.Len() != 2 {
+		t.Fatalf("expected 2 pending funcs, got %d", c.Len())
+	}
+}
+
+func TestRegisteredDuringCleanup(t *testing.T) {
+	var left []string
+	c := closer.New()
+	c.DeferNamed("db", func() {})
+	c.DeferNamed("stuck", func() { left = c.Registered() })
+	c.DeferNamed("cache", func() {})
+	c.Close()
+	if exp := "[db]"; fmt.Sprint(left) != exp {
+		t.Fatalf("expected %v, got %v", exp, left)
+	}
+}
+
+func TestExit(t *testing.T) {
+	var code int
+	closer.ExitFunc = func(c int) { code = c }
+	defer func() { closer.ExitFunc = os.Exit }()
+
+	c := closer.New()
+	c.Defer(func() error { return errors.New("fail") })
+	c.Exit(-1)
+	if code != closer.ExitCodeErr {
+		t.Fatalf("expected %d, got %d", closer.ExitCodeErr, code)
+	}
+	code = 0
+	c.Exit(-1)
+	if code != closer.ExitCodeErr {
+		t.Fatalf("expected the cached result %d, got %d", closer.ExitCodeErr, code)
+	}
+
+	closer.ExitCodeFunc = func(sig os.Signal, errored bool) int {
+		if sig == nil && errored {
+			return 42
+		}
+		return 0
+	}
+	defer func() { closer.ExitCodeFunc = nil }()
+	c.Exit(-1)
+	if code != 42 {
+		t.Fatalf("expected 42, got %d", code)
+	}
+}
+
+func TestDeferFirst(t *testing.T) {
+	var vals []int
+	c := closer.New()
+	c.Defer(func() { vals = append(vals, 1) })
+	c.DeferFirst(func() { vals = append(vals, 3) })
+	c.Defer(func() { vals = append(vals, 0) })
+
+	c.Close()
+	if exp := "[0 1 3]"; fmt.Sprint(vals) != exp {
+		t.Fatalf("expected %v, got %v", exp, vals)
+	}
+}
+
+type stopper struct{ stopped bool }
+
+func (s *stopper) Stop() { s.stopped = true }
+
+func TestOnUnsupported(t *testing.T) {
+	closer.OnUnsupported = func(v interface{}) (func() error, bool) {
+		switch v := v.(type) {
+		case *stopper:
+			return func() error { v.Stop(); return nil }, true
+		case string:
+			return nil, true
+		}
+		return nil, false
+	}
+	defer func() { closer.OnUnsupported = nil }()
+
+	var s stopper
+	c := closer.New()
+	c.Defer(&s, "skipped")
+	if c.Close(); !s.stopped {
+		t.Fatal("expected the adapted closer to run")
+	}
+	defer func() {
+		if p := fmt.Sprint(recover()); !strings.Contains(p, "func(Reason) error, context.CancelCauseFunc") {
+			t.Fatalf("expected a panic listing the supported types, got %v", p)
+		}
+	}()
+	c.Defer(42)
+}
+
+func TestPanicError(t *testing.T) {
+	c := closer.New()
+	c.Defer(func() { panic("boom") })
+
+	var perr *closer.PanicError
+	if err := c.Close(); !errors.As(err, &perr) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if perr.Value != "boom" || !strings.Contains(string(perr.Stack), "TestPanicError") {
+		t.Fatalf("unexpected panic error: %v\n%s", perr.Value, perr.Stack)
+	}
+
+	errFoo := errors.New("foo")
+	c = closer.New()
+	c.Defer(func() { panic(fmt.Errorf("wrapped: %w", errFoo)) }, func() error { return errFoo })
+	err := c.Close()
+	if errs := unwrapAll(err); !errors.Is(errs[0], errFoo) || errors.Is(errs[0], closer.ErrPanic) || !errors.Is(errs[1], closer.ErrPanic) {
+		t.Fatalf("unexpected errors: %v", err)
+	}
+}
+
+type ctxCloser struct{ ctx context.Context }
+
+func (c *ctxCloser) Close(ctx context.Context) error { c.ctx = ctx; return nil }
+
+func TestDeferCtxCloser(t *testing.T) {
+	closer.CleanupTimeout = time.Second
+	defer func() { closer.CleanupTimeout = 0 }()
+
+	var cc ctxCloser
+	c := closer.New()
+	c.Defer(&cc)
+	c.Close()
+	if cc.ctx == nil {
+		t.Fatal("Close wasn't called")
+	}
+	if _, ok := cc.ctx.Deadline(); !ok {
+		t.Fatal("expected the cleanup context")
+	}
+}
+
+func TestDeferWaitGroup(t *testing.T) {
+	var (
+		wg   sync.WaitGroup
+		done bool
+	)
+	wg.Add(1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		done = true
+		wg.Done()
+	}()
+	c := closer.New()
+	c.Defer(&wg)
+	c.Close()
+	if !done {
+		t.Fatal("expected Close to wait for the WaitGroup")
+	}
+}
+
+func TestCleanupHooks(t *testing.T) {
+	var before, after int
+	closer.OnBeforeCleanup = func(os.Signal) { before++ }
+	closer.OnAfterCleanup = func(errored bool, d time.Duration) {
+		if errored {
+			after++
+		}
+	}
+	defer func() { closer.OnBeforeCleanup, closer.OnAfterCleanup = nil, nil }()
+
+	c := closer.New()
+	fn := c.Defer(func() error { return errors.New("fail") })
+	fn()
+	fn()
+	c.Close()
+	if before != 2 || after != 1 {
+		t.Fatalf("unexpected calls, before: %d, after: %d", before, after)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	c := closer.New()
+	c.DeferNamed("db", func() error { return errors.New("fail") })
+	c.Defer(func() {})
+	evs := c.Events()
+	c.Close()
+
+	var got []string
+	for ev := range evs {
+		got = append(got, fmt.Sprintf("%d:%s:%v", ev.Index, ev.Name, ev.Err))
+	}
+	if exp := "[1::<nil> 0:db:fail]"; fmt.Sprint(got) != exp {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+
+	c = closer.New()
+	c.DeferNamed("db", func() {})
+	c.DeferNamed("dashboard", func() { evs = c.Events() }) // subscribing once the cleanup started
+	c.Close()
+	got = nil
+	for ev := range evs {
+		got = append(got, ev.Name)
+	}
+	if exp := "[dashboard db]"; fmt.Sprint(got) != exp {
+		t.Fatalf("expected %v during the cleanup, got %v", exp, got)
+	}
+	if _, ok := <-c.Events(); ok {
+		t.Fatal("expected a closed channel once drained")
+	}
+}
+
+func TestNestedDefer(t *testing.T) {
+	var vals []int
+	c := closer.New()
+	c.Defer(func() { vals = append(vals, 2) })
+	c.Defer(func() {
+		vals = append(vals, 0)
+		c.Defer(func() { vals = append(vals, 1) })
+	})
+
+	done := make(chan struct{})
+	go func() { c.Close(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deadlock")
+	}
+	if exp := "[0 2 1]"; fmt.Sprint(vals) != exp {
+		t.Fatalf("expected %v, got %v", exp, vals)
+	}
+}
+
+func TestOrderFIFO(t *testing.T) {
+	closer.Order = closer.FIFO
+	defer func() { closer.Order = closer.LIFO }()
+
+	var vals []int
+	c := closer.New()
+	c.Defer(func() { vals = append(vals, 0) }, func() { vals = append(vals, 1) })
+	c.Close()
+	if exp := "[0 1]"; fmt.Sprint(vals) != exp {
+		t.Fatalf("expected %v, got %v", exp, vals)
+	}
+
+	c = closer.New()
+	c.DeferFirst(func() {})       // 0
+	c.Defer(func() {}, func() {}) // 1, 2
+	c.Barrier(0)                  // 3
+	c.Defer(func() {}, func() {}) // 4, 5
+	var got []int
+	for _, e := range c.Plan() {
+		got = append(got, e.Index)
+	}
+	if exp := "[4 5 3 1 2 0]"; fmt.Sprint(got) != exp {
+		t.Fatalf("expected DeferFirst and Barrier to keep their position, got %v", got)
+	}
+}
+
+func TestDeferCancelFunc(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cctx, ccancel := context.WithCancelCause(context.Background())
+	c := closer.New()
+	c.Defer(cancel, ccancel)
+	c.Close()
+	if ctx.Err() == nil {
+		t.Fatal("expected ctx to be cancelled")
+	}
+	if context.Cause(cctx) != closer.ErrShutdown {
+		t.Fatalf("unexpected cause: %v", context.Cause(cctx))
+	}
+}
+
+func TestRun(t *testing.T) {
+	var closed bool
+	c := closer.New()
+	code := c.Run(func() error {
+		c.Defer(func() { closed = true })
+		return errors.New("fail")
+	})
+	if code != closer.ExitCodeErr || !closed {
+		t.Fatalf("unexpected exit code %d, closed: %v", code, closed)
+	}
+}
+
+func TestPanicContinues(t *testing.T) {
+	add, order := closertest.Recorder()
+	c := closer.New()
+	c.Defer(add("2"), runtime.Goexit, add("1"), func() { panic("boom") }, add("0"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Close()
+	}()
+	<-done
+
+	if exp, vals := "[0 1 2]", order(); fmt.Sprint(vals) != exp {
+		t.Fatalf("expected %v, got %v", exp, vals)
+	}
+	if err := c.Close(); len(unwrapAll(err)) != 2 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWatchdogTimeout(t *testing.T) {
+	codes := make(chan int, 2)
+	closer.ExitFunc = func(code int) { codes <- code }
+	closer.WatchdogTimeout = 20 * time.Millisecond
+	defer func() { closer.ExitFunc, closer.WatchdogTimeout = os.Exit, 0 }()
+
+	release := make(chan struct{})
+	c := closer.New()
+	c.SetExitCodes(0, 3, false)
+	c.Defer(func() { <-release })
+	go c.Exit(0)
+	if code := <-codes; code != 3 {
+		t.Fatalf("expected the watchdog to exit with 3, got %d", code)
+	}
+	close(release)
+	if code := <-codes; code != 0 {
+		t.Fatalf("expected 0, got %d", code)
+	}
+}
+
+func TestSetExitCodes(t *testing.T) {
+	var code int
+	closer.ExitFunc = func(c int) { code = c }
+	defer func() { closer.ExitFunc = os.Exit }()
+
+	c := closer.New()
+	c.SetExitCodes(10, 11, false)
+	c.Exit(-1)
+	if code != 10 {
+		t.Fatalf("expected 10, got %d", code)
+	}
+}
+
+type flushCloser struct {
+	calls []string
+}
+
+func (w *flushCloser) Flush() error { w.calls = append(w.calls, "flush"); return io.ErrShortWrite }
+func (w *flushCloser) Close() error { w.calls = append(w.calls, "close"); return nil }
+
+func TestDeferFlushClose(t *testing.T) {
+	var w flushCloser
+	c := closer.New()
+	c.DeferFlushClose(&w)
+	if err := c.Close(); !errors.Is(err, io.ErrShortWrite) || fmt.Sprint(w.calls) != "[flush close]" {
+		t.Fatalf("unexpected result: %v, %v", err, w.calls)
+	}
+}
+
+func TestDeferRetry(t *testing.T) {
+	var n int
+	c := closer.New()
+	c.DeferRetry(3, time.Millisecond, func() error {
+		if n++; n < 3 {
+			return io.EOF
+		}
+		return nil
+	})
+	if err := c.Close(); err != nil || n != 3 {
+		t.Fatalf("unexpected result: %v, %d", err, n)
+	}
+
+	n = 0
+	c = closer.New()
+	c.DeferRetry(2, time.Millisecond, func() error { n++; return io.EOF })
+	if err := c.Close(); err != io.EOF || n != 2 {
+		t.Fatalf("unexpected result: %v, %d", err, n)
+	}
+}
+
+func TestDeferToggle(t *testing.T) {
+	var n int
+	c := closer.New()
+	cancel, rearm := c.DeferToggle(func() error { n++; return nil })
+	cancel()
+	if c.Len() != 0 {
+		t.Fatalf("expected cancel to remove the func, got %d", c.Len())
+	}
+	rearm()
+	rearm()
+	if c.Len() != 1 {
+		t.Fatalf("expected rearm to register the func once, got %d", c.Len())
+	}
+	c.Close()
+	if n != 1 {
+		t.Fatalf("expected 1 call, got %d", n)
+	}
+}
+
+func TestDeferSafe(t *testing.T) {
+	var reported []error
+	closer.OnError = func(err error) { reported = append(reported, err) }
+	defer func() { closer.OnError = nil }()
+
+	var fellBack bool
+	c := closer.New()
+	c.DeferSafe(func() error { panic("remote down") }, func() error { fellBack = true; return io.EOF })
+	c.DeferSafe(func() error { return nil }, func() error { t.Error("unexpected fallback"); return nil })
+	if err := c.Close(); err != io.EOF || !fellBack {
+		t.Fatalf("unexpected result: %v, %v", err, fellBack)
+	}
+	if len(reported) != 2 || !errors.Is(reported[0], closer.ErrPanic) || reported[1] != io.EOF {
+		t.Fatalf("unexpected reported errors: %v", reported)
+	}
+}
+
+func TestBarrier(t *testing.T) {
+	var (
+		mux   sync.Mutex
+		order []string
+	)
+	log := func(s string) { mux.Lock(); order = append(order, s); mux.Unlock() }
+	c := closer.New()
+	c.Defer(func() { log("after") })
+	ready := c.Barrier(2)
+	for _, name := range []string{"a", "b"} {
+		name := name
+		go func() {
+			for !c.Shutting() {
+				time.Sleep(time.Millisecond)
+			}
+			log(name)
+			ready()
+		}()
+	}
+	c.Defer(func() { log("before") })
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 4 || order[3] != "after" {
+		t.Fatalf("unexpected order: %v", order)
+	}
+
+	c = closer.New(closer.WithTimeout(10 * time.Millisecond))
+	c.Barrier(1)
+	if err := c.Close(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the barrier to time out, got %v", err)
+	}
+}
+
+func TestDeferIf(t *testing.T) {
+	var initialized bool
+	var calls, n int
+	c := closer.New()
+	c.DeferIf(func() bool { calls++; return initialized }, func() { n++ }, func() { n++ })
+	c.DeferIf(func() bool { calls++; return false }, func() { t.Error("unexpected call") })
+	initialized = true
+	c.Close()
+	if n != 2 || calls != 2 {
+		t.Fatalf("unexpected result: %d funcs ran, cond called %d times", n, calls)
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	warned := make(chan string, 1)
+	closer.GracePeriod = 20 * time.Millisecond
+	closer.Logger = logFunc(func(format string, v ...interface{}) {
+		if strings.Contains(format, "grace period") {
+			warned <- fmt.Sprintf(format, v...)
+		}
+	})
+	defer func() { closer.GracePeriod, closer.Logger = 0, nil }()
+
+	c := closer.New()
+	c.Defer(func() { time.Sleep(30 * time.Millisecond) })
+	c.Close()
+	select {
+	case <-warned:
+	default:
+		t.Fatal("expected a grace period warning")
+	}
+
+	c = closer.New()
+	c.Defer(func() {})
+	c.Close()
+	if time.Sleep(30 * time.Millisecond); len(warned) > 0 {
+		t.Fatal("unexpected warning for a fast cleanup")
+	}
+}
+
+func TestDeferInit(t *testing.T) {
+	var order []string
+	log := func(s string) func() { return func() { order = append(order, s) } }
+	c := closer.New()
+	c.DeferInit(closer.PhaseUI, log("ui"))
+	c.DeferInit(closer.PhaseInfra, log("db"), log("logger"))
+	c.Defer(log("app"))
+	c.DeferInit(closer.PhaseUI, log("http"))
+	c.Close()
+	if exp := "[http ui app logger db]"; fmt.Sprint(order) != exp {
+		t.Fatalf("expected %v, got %v", exp, order)
+	}
+}
+
+func TestDeferDrain(t *testing.T) {
+	var phases []string
+	c := closer.New()
+	c.DeferDrain(func() { phases = append(phases, "stop") }, func(ctx context.Context) error {
+		phases = append(phases, "drain")
+		return errors.New("timeout")
+	}, func() error {
+		phases = append(phases, "close")
+		return nil
+	})
+	if err := c.Close(); err == nil || err.Error() != "drain: timeout" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := "[stop drain close]"; fmt.Sprint(phases) != exp {
+		t.Fatalf("expected %v, got %v", exp, phases)
+	}
+}
+
+func TestDeferOnce(t *testing.T) {
+	var n int
+	c := closer.New()
+	c.DeferOnce("db", func() { n++ })
+	c.DeferOnce("db", func() { n++ })()
+	c.Close()
+	if n != 1 {
+		t.Fatalf("expected 1 call, got %d", n)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	closer.Logger = log.New(&buf, "", 0)
+	closer.ExitFunc = func(int) {}
+	defer func() { closer.Logger, closer.ExitFunc = nil, os.Exit }()
+
+	c := closer.New()
+	c.DeferNamed("db", func() {})
+	c.Exit(3)
+	if exp := "closer: running db\ncloser: db returned after"; !strings.HasPrefix(buf.String(), exp) {
+		t.Fatalf("unexpected log: %q", buf.String())
+	}
+	if !strings.HasSuffix(buf.String(), "closer: exiting with code 3\n") {
+		t.Fatalf("unexpected log: %q", buf.String())
+	}
+}
+
+func TestDeferServer(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer close(block)
+	go http.Get(srv.URL)
+	time.Sleep(50 * time.Millisecond)
+
+	c := closer.New()
+	c.DeferServer(srv.Config, 10*time.Millisecond)
+	start := time.Now()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("shutdown took %v", d)
+	}
+	if _, err := http.Get(srv.URL); err == nil {
+		t.Fatal("expected the server to be closed")
+	}
+}
+
+func TestDeferContext(t *testing.T) {
+	closer.CleanupTimeout = 20 * time.Millisecond
+	defer func() { closer.CleanupTimeout = 0 }()
+
+	c := closer.New()
+	var ctxErr error
+	c.DeferContext(func(ctx context.Context) error {
+		<-ctx.Done()
+		ctxErr = ctx.Err()
+		return nil
+	})
+	c.Close()
+	if ctxErr != context.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", ctxErr)
+	}
+}
+
+func TestShutting(t *testing.T) {
+	c := closer.New()
+	var shutting bool
+	c.Defer(func() { shutting = c.Shutting() })
+	if c.Shutting() {
+		t.Fatal("shutting before Close")
+	}
+	if c.Close(); !shutting || !c.Shutting() {
+		t.Fatal("expected shutting to be set")
+	}
+	if c.Reset(); c.Shutting() {
+		t.Fatal("shutting after Reset")
+	}
+}
+
+func TestHandleCrash(t *testing.T) {
+	var code int
+	closer.ExitFunc = func(c int) { code = c }
+	defer func() { closer.ExitFunc = os.Exit }()
+
+	var ran bool
+	c := closer.New()
+	c.Defer(func() { ran = true })
+	func() {
+		defer c.HandleCrash()
+		panic("boom")
+	}()
+	if !ran || code != closer.ExitCodeErr {
+		t.Fatalf("unexpected result: %v, %d", ran, code)
+	}
+}
+
+func TestLastErrored(t *testing.T) {
+	c := closer.New()
+	c.Defer(func() error { return io.EOF })
+	if c.LastErrored() {
+		t.Fatal("errored before Close")
+	}
+	if c.Close(); !c.LastErrored() {
+		t.Fatal("expected LastErrored to be set")
+	}
+	c.Reset()
+	if c.Close(); c.LastErrored() {
+		t.Fatal("expected LastErrored to be reset by a clean drain")
+	}
+}
+
+func TestDone(t *testing.T) {
+	c := closer.New()
+	done := c.Done()
+	c.Defer(func() {
+		select {
+		case <-done:
+			t.Error("done closed before the funcs ran")
+		default:
+		}
+	})
+	c.Close()
+	select {
+	case <-done:
+	default:
+		t.Fatal("done wasn't closed")
+	}
+	if c.Reset(); c.Done() == done {
+		t.Fatal("expected a new channel after Reset")
+	}
+}
+
+func TestAtExit(t *testing.T) {
+	var n int
+	c := closer.New()
+	c.Defer(func() { n++ })
+	func() {
+		defer c.AtExit()()
+	}()
+	c.AtExit()()
+	c.Close()
+	if n != 1 {
+		t.Fatalf("expected 1 run, got %d", n)
+	}
+}
+
+func TestOnClose(t *testing.T) {
+	var got []string
+	closer.OnClose = func(name, summary string, err error) {
+		got = append(got, fmt.Sprintf("%s:%s:%v", name, summary, err))
+	}
+	defer func() { closer.OnClose = nil }()
+
+	c := closer.New()
+	c.Defer(func() {})
+	c.DeferNamed("cache", func() (string, error) { return "flushed 128 keys", nil })
+	ch := c.Events()
+	c.Close()
+	if exp := "[cache:flushed 128 keys:<nil> #0::<nil>]"; fmt.Sprint(got) != exp {
+		t.Fatalf("expected %s, got %v", exp, got)
+	}
+	if ev := <-ch; ev.Summary != "flushed 128 keys" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
+
+func TestOnErrorPanic(t *testing.T) {
+	closer.OnError = func(err error) { panic(err) }
+	closer.Logger = logFunc(func(string, ...interface{}) {})
+	defer func() { closer.OnError, closer.Logger = nil, nil }()
+
+	var ran bool
+	c := closer.New()
+	c.Defer(func() { ran = true }, func() error { return io.EOF })
+	if err := c.Close(); !errors.Is(err, io.EOF) || !ran {
+		t.Fatalf("unexpected result: %v, %v", err, ran)
+	}
+}
+
+func TestDeferAfter(t *testing.T) {
+	add, order := closertest.Recorder()
+	c := closer.New()
+	db := c.DeferHandle(add("db"))
+	c.DeferAfter(db, add("pool"))
+	c.DeferP(10, add("metrics"))
+	c.DeferAfter(db, add("cache")).After(c.DeferHandle(add("logger")))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if exp, vals := "[metrics logger db cache pool]", order(); fmt.Sprint(vals) != exp {
+		t.Fatalf("expected %s, got %v", exp, vals)
+	}
+
+	add, order = closertest.Recorder()
+	c = closer.New()
+	x := c.DeferHandle(add("x"))
+	x.After(c.DeferAfter(x, add("y")))
+	err, vals := c.Close(), order()
+	if err == nil || !strings.Contains(err.Error(), "dependency cycle") || fmt.Sprint(vals) != "[y x]" {
+		t.Fatalf("unexpected result: %v, %v", err, vals)
+	}
+}
+
+func TestCloseCtx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var ran bool
+	c := closer.New()
+	c.Defer(func() { ran = true })
+	c.Defer(cancel)
+	err := c.CloseCtx(ctx)
+	if !errors.Is(err, context.Canceled) || ran {
+		t.Fatalf("unexpected result: %v, %v", err, ran)
+	}
+
+	c = closer.New()
+	c.Defer(func() { ran = true })
+	err = c.CloseCtx(ctx) // already cancelled
+	if !errors.Is(err, context.Canceled) || ran || !c.LastErrored() || c.Len() != 1 {
+		t.Fatalf("unexpected result: %v, %v, %v, %d", err, ran, c.LastErrored(), c.Len())
+	}
+	if err := c.Close(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the skipped funcs to still be reported, got %v", err)
+	}
+}
+
+func TestJSONLog(t *testing.T) {
+	var buf bytes.Buffer
+	closer.JSONLog = &buf
+	defer func() { closer.JSONLog = nil }()
+
+	c := closer.New()
+	c.Defer(func() error { return io.EOF })
+	c.DeferNamed("db", func() {})
+	c.Close()
+	var recs []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for {
+		var rec map[string]interface{}
+		if err := dec.Decode(&rec); err != nil {
+			break
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 3 || recs[0]["name"] != "db" || recs[0]["error"] != nil || recs[1]["error"] != "EOF" ||
+		recs[2]["closers"] != 2.0 || recs[2]["errored"] != 1.0 {
+		t.Fatalf("unexpected records: %v", recs)
+	}
+}
+
+func TestCloseReport(t *testing.T) {
+	c := closer.New()
+	c.DeferNamed("db", func() { time.Sleep(10 * time.Millisecond) })
+	c.Defer(func() error { return io.EOF })
+	rep, err := c.CloseReport()
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rep.Attempted != 2 || rep.Errored != 1 || len(rep.Closers) != 2 || rep.Duration < 10*time.Millisecond {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+	if db := rep.Closers[1]; db.Name != "db" || db.Duration < 10*time.Millisecond || db.Err != nil {
+		t.Fatalf("unexpected db entry: %+v", db)
+	}
+}
+
+func TestAddRemoveSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGQUIT on windows")
+	}
+	exited := make(chan int, 1)
+	closer.ExitFunc = func(code int) { exited <- code }
+	defer func() { closer.ExitFunc = os.Exit }()
+
+	c := closer.New(closer.WithSignals(syscall.SIGINT))
+	defer c.Stop() // a leftover SIGQUIT handler would catch the signal of the next run
+	c.AddSignal(syscall.SIGQUIT)
+	c.RemoveSignal(syscall.SIGINT)
+	p, _ := os.FindProcess(os.Getpid())
+	p.Signal(syscall.SIGQUIT)
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("SIGQUIT wasn't handled")
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	closer.RecoverPanics = false
+	defer func() { closer.RecoverPanics = true }()
+
+	c := closer.New()
+	c.Defer(func() { panic("boom") })
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Fatalf("unexpected panic: %v", p)
+		}
+	}()
+	c.Close()
+	t.Fatal("expected a panic")
+}
+
+func TestHandleCancel(t *testing.T) {
+	var ran bool
+	c := closer.New()
+	h := c.DeferHandle(func() { ran = true })
+	h.Cancel()
+	h.Run()
+	if err := c.Close(); err != nil || ran {
+		t.Fatalf("expected a cancelled handle to never run, err: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	var vals []int
+	a, b := closer.New(), closer.New()
+	a.Defer(func() { vals = append(vals, 1) }, func() error { return errors.New("a") })
+	b.Defer(func() { vals = append(vals, 2) })
+
+	if err := a.Close(); err == nil || err.Error() != "a" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(vals) != 1 || vals[0] != 1 {
+		t.Fatalf("unexpected output: %v", vals)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(vals) != 2 || vals[1] != 2 {
+		t.Fatalf("unexpected output: %v", vals)
+	}
+}
+
+func TestCloseAll(t *testing.T) {
+	a, b := closer.New(closer.WithCloseAll()), closer.New(closer.WithCloseAll())
+	private, stopped := closer.New(), closer.New(closer.WithCloseAll())
+	fail := func() error { return errors.New("fail") }
+	a.Defer(fail, func() {}, fail)
+	b.Defer(func() {}, fail)
+	private.Defer(fail)
+	stopped.Defer(fail)
+	stopped.Stop()
+
+	if err := closer.CloseAll(); len(unwrapAll(err)) != 3 {
+		t.Fatalf("expected 3 errors, got %v", err)
+	}
+	if private.Len() != 1 || stopped.Len() != 1 {
+		t.Fatalf("expected CloseAll to leave the other closers alone, got %d, %d", private.Len(), stopped.Len())
+	}
+	if err := closer.CloseAll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCleanupTimeout(t *testing.T) {
+	closer.CleanupTimeout = 20 * time.Millisecond
+	defer func() { closer.CleanupTimeout = 0 }()
+
+	var ran, hasDeadline bool
+	c := closer.New()
+	c.Defer(func() { ran = true }, func(ctx context.Context) error {
+		_, hasDeadline = ctx.Deadline()
+		<-ctx.Done()
+		return nil
+	})
+
+	if err := c.Close(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !hasDeadline {
+		t.Fatal("expected the context to have a deadline")
+	}
+	if ran {
+		t.Fatal("expected the remaining funcs to be skipped")
+	}
+}
+
+func TestLateDeferSkipped(t *testing.T) {
+	var ran bool
+	c := closer.New(closer.WithTimeout(10 * time.Millisecond))
+	c.Defer(func() {
+		time.Sleep(20 * time.Millisecond)
+		c.Defer(func() { ran = true })
+	})
+	if err := c.Close(); !errors.Is(err, context.DeadlineExceeded) || ran || c.Len() != 1 {
+		t.Fatalf("unexpected result: %v, %v, %d", err, ran, c.Len())
+	}
+
+	closer.StopOnFirstError = true
+	defer func() { closer.StopOnFirstError = false }()
+	c = closer.New()
+	c.Defer(func() error {
+		c.Defer(func() { ran = true })
+		return io.EOF
+	})
+	if err := c.Close(); len(unwrapAll(err)) != 2 || !strings.Contains(err.Error(), "skipped 1 funcs") || ran {
+		t.Fatalf("unexpected result: %v, %v", err, ran)
+	}
+}
+
+func TestConfigureFromEnv(t *testing.T) {
+	useSignal, timeout := closer.ExitWithSignalCode, closer.CleanupTimeout
+	defer func() { closer.SetExitWithSignalCode(useSignal); closer.SetCleanupTimeout(timeout) }()
+
+	t.Setenv("CLOSER_EXIT_SIGNAL_CODE", "0")
+	t.Setenv("CLOSER_CLEANUP_TIMEOUT", "10s")
+	if err := closer.ConfigureFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if closer.ExitWithSignalCode || closer.CleanupTimeout != 10*time.Second {
+		t.Fatalf("unexpected settings: %v, %v", closer.ExitWithSignalCode, closer.CleanupTimeout)
+	}
+	t.Setenv("CLOSER_CLEANUP_TIMEOUT", "10")
+	if err := closer.ConfigureFromEnv(); err == nil || closer.CleanupTimeout != 10*time.Second {
+		t.Fatalf("expected a parse error, got %v", err)
+	}
+}
+
+func TestSetShutdownDeadline(t *testing.T) {
+	deadline := time.Now().Add(time.Hour)
+	closer.SetShutdownDeadline(deadline)
+	closer.CleanupTimeout = 2 * time.Hour
+	defer func() { closer.SetShutdownDeadline(time.Time{}); closer.CleanupTimeout = 0 }()
+
+	var got time.Time
+	c := closer.New()
+	c.Defer(func(ctx context.Context) error { got, _ = ctx.Deadline(); return nil })
+	c.Close()
+	if !got.Equal(deadline) {
+		t.Fatalf("expected %v, got %v", deadline, got)
+	}
+
+	exits := make(chan int, 1)
+	c = closer.New(closer.WithExitFunc(func(code int) { exits <- code }))
+	defer c.Stop()
+	c.Defer(func() {})
+	go c.SimulateSignal(syscall.SIGTERM)
+	closer.SetShutdownDeadline(deadline.Add(time.Minute)) // races with the signal cleanup starting
+	<-exits
+
+	closer.SetShutdownDeadline(time.Now().Add(-time.Second))
+	var ran bool
+	c = closer.New(closer.WithExitFunc(func(code int) { exits <- code }))
+	c.Defer(func() { ran = true })
+	c.Exit(-1)
+	if code := <-exits; code != closer.ExitCodeErr || ran {
+		t.Fatalf("expected a passed deadline to fail the cleanup, got %d, %v", code, ran)
+	}
+}
+
+func TestDeferWithTimeout(t *testing.T) {
+	var ran bool
+	c := closer.New()
+	block := make(chan struct{})
+	defer close(block)
+	c.DeferWithTimeout(10*time.Millisecond, func() { ran = true }, func() { <-block })
+
+	if err := c.Close(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ran {
+		t.Fatal("expected the next func to run after the timeout")
+	}
+}
+
+func TestDeferCleanSignal(t *testing.T) {
+	exited := make(chan int, 1)
+	closer.ExitFunc = func(code int) { exited <- code }
+	defer func() { closer.ExitFunc = os.Exit }()
+
+	add, order := closertest.Recorder()
+	c := closer.New()
+	c.Defer(add("any"))
+	c.DeferClean(add("clean"))
+	c.DeferSignal(add("signal"))
+	c.Close()
+	if vals := order(); fmt.Sprint(vals) != "[clean any]" || c.Len() != 0 {
+		t.Fatalf("unexpected result: %v", vals)
+	}
+
+	add, order = closertest.Recorder()
+	c = closer.New()
+	c.Defer(add("any"))
+	c.DeferClean(add("clean"))
+	c.DeferSignal(add("signal"))
+	c.SimulateSignal(syscall.SIGTERM)
+	<-exited
+	if vals := order(); fmt.Sprint(vals) != "[signal any]" {
+		t.Fatalf("unexpected result: %v", vals)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	var (
+		code int
+		buf  bytes.Buffer
+	)
+	c := closer.New(closer.WithTimeout(time.Hour), closer.WithLogger(log.New(&buf, "", 0)), closer.WithExitFunc(func(c int) { code = c }))
+	var deadline time.Time
+	c.Defer(func(ctx context.Context) error { deadline, _ = ctx.Deadline(); return nil })
+	c.Exit(4)
+	if code != 4 || time.Until(deadline) < 59*time.Minute || !strings.Contains(buf.String(), "exiting with code 4") {
+		t.Fatalf("unexpected result: %d, %v, %q", code, deadline, buf.String())
+	}
+}
+
+func TestSignalBufferSize(t *testing.T) {
+	defer func() { closer.SignalBufferSize = 1 }()
+
+	for _, tc := range []struct{ size, buffered int }{{0, 1}, {2, 2}} {
+		closer.SignalBufferSize = tc.size
+		exits := make(chan int, 10)
+		entered, release, block := make(chan struct{}), make(chan struct{}), make(chan struct{})
+		c := closer.New(closer.WithExitFunc(func(code int) { exits <- code }))
+		c.SetSignalAction(syscall.SIGINT, closer.Custom(func(os.Signal) { entered <- struct{}{}; <-release }))
+		c.Defer(func() { <-block })
+
+		c.SimulateSignal(syscall.SIGINT)
+		<-entered // the handler is busy, so the next signals stay in the buffer
+		sent := make(chan struct{}, 3)
+		go func() {
+			for i := 0; i < 3; i++ {
+				c.SimulateSignal(syscall.SIGTERM)
+				sent <- struct{}{}
+			}
+		}()
+		if time.Sleep(20 * time.Millisecond); len(sent) != tc.buffered {
+			t.Fatalf("SignalBufferSize = %d: expected %d buffered signals, got %d", tc.size, tc.buffered, len(sent))
+		}
+
+		// the first buffered SIGTERM starts the cleanup, the next one forces the exit while it's blocked.
+		close(release)
+		select {
+		case code := <-exits:
+			if code != closer.ExitCodeErr {
+				t.Fatalf("unexpected exit code: %d", code)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("SignalBufferSize = %d: expected a forced exit", tc.size)
+		}
+		close(block)
+		for i := 0; i < 3; i++ {
+			<-sent
+		}
+		c.Stop()
+	}
+}
+
+func TestNotify(t *testing.T) {
+	exits := make(chan int, 1)
+	c := closer.New(closer.WithExitFunc(func(code int) { exits <- code }))
+	defer c.Stop()
+	ch, seen := make(chan os.Signal, 3), c.SignalChan()
+	c.Notify(ch)
+	c.OnReload(func() error { return nil })
+
+	c.SimulateSignal(syscall.SIGHUP)
+	<-seen
+	release := c.Hold()
+	c.SimulateSignal(syscall.SIGTERM)
+	<-seen
+	release()
+	var relayed int
+	c.Defer(func() { relayed = len(ch) })
+	c.SimulateSignal(syscall.SIGINT)
+	<-exits
+	if relayed != 1 || <-ch != syscall.SIGINT {
+		t.Fatalf("expected only the cleanup signal to be relayed before the funcs run, got %d", relayed)
+	}
+}
+
+func TestSignalFunc(t *testing.T) {
+	var sigs []os.Signal
+	record := func(sig os.Signal) error { sigs = append(sigs, sig); return nil }
+
+	exits := make(chan int, 2)
+	c := closer.New(closer.WithExitFunc(func(code int) { exits <- code }))
+	defer c.Stop()
+	c.Defer(record)
+	c.SimulateSignal(syscall.SIGTERM)
+	<-exits
+
+	c = closer.New(closer.WithExitFunc(func(code int) { exits <- code }))
+	c.Defer(record)
+	c.Exit(0)
+	<-exits
+	c = closer.New()
+	c.Defer(record)
+	c.Close()
+	c = closer.New()
+	c.Defer(record)()
+
+	if exp := "[terminated <nil> <nil> <nil>]"; fmt.Sprint(sigs) != exp {
+		t.Fatalf("expected %v, got %v", exp, sigs)
+	}
+}
+
+func TestContextCancelledOnSignal(t *testing.T) {
+	exits := make(chan int, 1)
+	c := closer.New(closer.WithExitFunc(func(code int) { exits <- code }))
+	defer c.Stop()
+	ctx := c.Context()
+	var err error
+	c.Defer(func() { err = ctx.Err() })
+	if ctx.Err() != nil {
+		t.Fatal("expected the context to be live before a signal")
+	}
+	c.SimulateSignal(syscall.SIGTERM)
+	<-exits
+	if err != context.Canceled {
+		t.Fatalf("expected the context to be cancelled before the funcs run, got %v", err)
+	}
+}
+
+func TestHold(t *testing.T) {
+	exits := make(chan int, 1)
+	c := closer.New(closer.WithExitFunc(func(code int) { exits <- code }))
+	defer c.Stop()
+	seen := c.SignalChan()
+	// signals are handled in order, so seeing one means the previous one was fully handled.
+	signal := func() { c.SimulateSignal(syscall.SIGTERM); <-seen }
+
+	release1, release2 := c.Hold(), c.Hold()
+	signal()
+	release1()
+	release1()
+	signal()
+	signal() // makes sure the previous one was handled
+	if len(exits) > 0 {
+		t.Fatal("expected the signals to be dropped while held")
+	}
+	release2()
+	if time.Sleep(20 * time.Millisecond); len(exits) > 0 {
+		t.Fatal("expected the held signals not to be queued")
+	}
+	signal()
+	select {
+	case <-exits:
+	case <-time.After(time.Second):
+		t.Fatal("expected a signal after the last release to cleanup")
+	}
+}
+
+func TestStop(t *testing.T) {
+	exited := make(chan int, 1)
+	closer.ExitFunc = func(code int) { exited <- code }
+	defer func() { closer.ExitFunc = os.Exit }()
+
+	closer.New().Stop() // the first Notify of the process starts os/signal's goroutine for good
+	before := runtime.NumGoroutine()
+	c := closer.New()
+	c.Stop()
+	c.Stop()
+	time.Sleep(10 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("expected the signal goroutine to exit, %d > %d", n, before)
+	}
+
+	var ran bool
+	c.Defer(func() { ran = true })
+	c.SimulateSignal(syscall.SIGTERM)
+	if <-exited; !ran {
+		t.Fatal("expected Defer to arm c again")
+	}
+}
+
+func TestSimulateSignalStop(t *testing.T) {
+	c := closer.New(closer.WithExitFunc(func(int) {}))
+	c.SetSignalAction(syscall.SIGHUP, closer.Ignore)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				c.SimulateSignal(syscall.SIGHUP)
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		c.Stop()
+		c.SetSignals(syscall.SIGHUP)
+	}
+	wg.Wait()
+	c.Stop()
+}
+
+func TestServeSignals(t *testing.T) {
+	var ran bool
+	c := closer.New(closer.WithSyncSignal(), closer.WithNoExit())
+	defer c.Stop()
+	c.Defer(func() { ran = true })
+	c.SimulateSignal(syscall.SIGTERM)
+	if time.Sleep(10 * time.Millisecond); ran {
+		t.Fatal("expected the cleanup to wait for ServeSignals")
+	}
+	if c.ServeSignals(); !ran {
+		t.Fatal("expected ServeSignals to run the cleanup")
+	}
+}
+
+func TestSetSignalAction(t *testing.T) {
+	exited := make(chan int, 1)
+	closer.ExitFunc = func(code int) { exited <- code }
+	defer func() { closer.ExitFunc = os.Exit }()
+
+	custom, reloaded := make(chan os.Signal, 1), make(chan struct{}, 1)
+	c := closer.New()
+	defer c.Stop()
+	c.OnReload(func() error { reloaded <- struct{}{}; return nil })
+	c.SetSignalAction(syscall.SIGTERM, closer.Ignore)
+	c.SetSignalAction(syscall.SIGINT, closer.Custom(func(sig os.Signal) { custom <- sig }))
+	c.SetSignalAction(syscall.SIGQUIT, closer.Reload)
+	c.SetSignalAction(syscall.SIGHUP, closer.Cleanup)
+
+	c.SimulateSignal(syscall.SIGTERM)
+	c.SimulateSignal(syscall.SIGINT)
+	if sig := <-custom; sig != syscall.SIGINT || len(exited) > 0 {
+		t.Fatalf("unexpected signal: %v, or SIGTERM wasn't ignored", sig)
+	}
+	c.SimulateSignal(syscall.SIGQUIT)
+	<-reloaded
+	c.SimulateSignal(syscall.SIGHUP)
+	select {
+	case <-exited:
+	case <-reloaded:
+		t.Fatal("expected SIGHUP to trigger the cleanup")
+	}
+}
+
+func TestSignalChan(t *testing.T) {
+	c := closer.New(closer.WithNoExit())
+	defer c.Stop()
+	ch := c.SignalChan()
+	c.SetSignalAction(syscall.SIGINT, closer.Ignore)
+	for i := 0; i < 20; i++ {
+		c.SimulateSignal(syscall.SIGINT)
+	}
+	c.SimulateSignal(syscall.SIGTERM)
+	<-c.Done()
+	if n := len(ch); n != cap(ch) {
+		t.Fatalf("expected a full buffer, got %d", n)
+	}
+	if sig := <-ch; sig != syscall.SIGINT {
+		t.Fatalf("unexpected signal: %v", sig)
+	}
+}
+
+func TestState(t *testing.T) {
+	c := closer.New()
+	var during closer.ShutdownState
+	c.Defer(func() { during = c.State() })
+	if s := c.State(); s != closer.Running {
+		t.Fatalf("unexpected state: %v", s)
+	}
+	c.Close()
+	if s := c.State(); during != closer.Closing || s != closer.Closed {
+		t.Fatalf("unexpected states: %v, %v", during, s)
+	}
+	if c.Reset(); c.State() != closer.Running {
+		t.Fatalf("expected Reset to bring c back to running, got %v", c.State())
+	}
+}
+
+func TestReason(t *testing.T) {
+	var reasons []closer.Reason
+	record := func(why closer.Reason) error { reasons = append(reasons, why); return nil }
+
+	c := closer.New()
+	c.Defer(record)
+	c.Close()
+	c = closer.New()
+	c.Defer(record)
+	c.Run(func() error { return io.EOF })
+	c = closer.New(closer.WithNoExit())
+	c.Defer(record)
+	c.SimulateSignal(syscall.SIGTERM)
+	<-c.Done()
+	c.Stop()
+
+	if len(reasons) != 3 || !reasons[0].Manual || reasons[1].Err != io.EOF || reasons[1].Manual || reasons[2].Signal != syscall.SIGTERM {
+		t.Fatalf("unexpected reasons: %+v", reasons)
+	}
+}
+
+func TestExitErr(t *testing.T) {
+	var fatal, reported error
+	closer.OnFatal, closer.OnError = func(err error) { fatal = err }, func(err error) { reported = err }
+	closer.ExitFunc = func(code int) {
+		if code != closer.ExitCodeErr {
+			t.Errorf("unexpected exit code: %d", code)
+		}
+	}
+	defer func() { closer.OnFatal, closer.OnError, closer.ExitFunc = nil, nil, os.Exit }()
+
+	var got error
+	c := closer.New()
+	c.Defer(func(why closer.Reason) error { got = why.Err; return nil })
+	c.ExitErr(io.EOF)
+	if fatal != io.EOF || reported != nil || got != io.EOF || c.LastReason().Err != io.EOF {
+		t.Fatalf("unexpected result: %v, %v, %v", fatal, reported, got)
+	}
+}
+
+func TestNoExit(t *testing.T) {
+	closer.ExitFunc = func(int) { panic("ExitFunc called") }
+	defer func() { closer.ExitFunc = os.Exit }()
+
+	var ran bool
+	c := closer.New()
+	c.NoExit()
+	c.Defer(func() { ran = true })
+	c.SimulateSignal(syscall.SIGTERM)
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("cleanup didn't run")
+	}
+	if !ran {
+		t.Fatal("the defered func didn't run")
+	}
+}
+
+func TestWaitContext(t *testing.T) {
+	exited := make(chan int, 1)
+	closer.ExitFunc = func(code int) { exited <- code }
+	defer func() { closer.ExitFunc = os.Exit }()
+
+	c := closer.New()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sig, err := c.WaitContext(ctx); sig != nil || err != context.Canceled {
+		t.Fatalf("unexpected result: %v, %v", sig, err)
+	}
+
+	go c.SimulateSignal(syscall.SIGTERM)
+	if sig, err := c.WaitContext(context.Background()); sig != syscall.SIGTERM || err != nil {
+		t.Fatalf("unexpected result: %v, %v", sig, err)
+	}
+
+	var ran bool
+	c.Defer(func() { ran = true })
+	c.SimulateSignal(syscall.SIGTERM)
+	if <-exited; !ran {
+		t.Fatal("expected the signal to run the cleanup once nothing waits")
+	}
+}
+
+func TestSimulateSignal(t *testing.T) {
+	exited := make(chan int, 1)
+	closer.ExitFunc = func(code int) { exited <- code }
+	defer func() { closer.ExitFunc = os.Exit }()
+
+	var got os.Signal
+	c := closer.New()
+	c.SetExitCodes(0, 1, true)
+	c.Defer(func() { got = c.LastSignal() })
+	c.SimulateSignal(syscall.SIGTERM)
+	if code := <-exited; code != int(syscall.SIGTERM) || got != syscall.SIGTERM {
+		t.Fatalf("unexpected result: %d, %v", code, got)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	if testSignal {
+		closer.ExitWithSignalCode = false
+		defer closer.Defer(func() { closer.ExitCodeErr = 55 })()
+		childReady()
+		select {}
+	}
+	if err := signalChild("TestSignal", sigterm, "TEST_SIGNAL=1"); err != nil {
+		if !strings.Contains(err.Error(), "55") {
+			t.Fatalf("unexpected exit code: %v", err)
+		}
+	} else {
+		t.Fatal("process exited without error")
+	}
+}
+
+func TestWait(t *testing.T) {
+	if testWait {
+		closer.Defer(func() { os.Exit(1) })
+		childReady()
+		if closer.Wait() == syscall.SIGTERM {
+			os.Exit(56)
+		}
+		os.Exit(0)
+	}
+	if err := signalChild("TestWait", sigterm, "TEST_WAIT=1"); err == nil || !strings.Contains(err.Error(), "56") {
+		t.Fatalf("unexpected exit code: %v", err)
+	}
+}
+
+func TestForceExit(t *testing.T) {
+	if testForce {
+		closer.ExitCodeErr = 57
+		defer closer.Defer(func() { select {} })()
+		childReady()
+		select {}
+	}
+	if err := signalChild("TestForceExit", []os.Signal{syscall.SIGTERM, syscall.SIGTERM}, "TEST_FORCE=1"); err == nil || !strings.Contains(err.Error(), "57") {
+		t.Fatalf("unexpected exit code: %v", err)
+	}
+}
+
+func TestOnReload(t *testing.T) {
+	if testReload {
+		closer.OnReload(func() error { closer.ExitCodeErr = 58; return errors.New("invalid config") })
+		closer.OnReload(func() error { closer.ExitCodeErr = 59; return nil })
+		defer closer.Defer(func() {})()
+		childReady()
+		select {}
+	}
+	if err := signalChild("TestOnReload", []os.Signal{syscall.SIGHUP, syscall.SIGTERM}, "TEST_RELOAD=1"); err == nil || !strings.Contains(err.Error(), "58") {
+		t.Fatalf("unexpected exit code: %v", err)
+	}
+}
+
+func BenchmarkLen(b *testing.B) {
+	c := closer.New()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if c.Len() != 0 {
+				b.Fatal("expected no funcs")
+			}
+		}
+	})
+}
+
+// BenchmarkCloseDrained compares repeated Close calls from many goroutines on a closer drained without errors,
+// which skip the lock, with ones on a closer whose drain errored, which lock to return the cached errors.
+func BenchmarkCloseDrained(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		fn   func() error
+	}{
+		{"clean", func() error { return nil }},
+		{"errored", func() error { return io.EOF }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			c := closer.New()
+			c.Defer(bc.fn)
+			c.Close()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c.Close()
+				}
+			})
+		})
+	}
+}
+
+var sigterm = []os.Signal{syscall.SIGTERM}
+
+const readyLine = "closer: child ready"
+
+func TestDumpOnSIGQUIT(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGQUIT on windows")
+	}
+	if testQuit {
+		var dumped bool
+		closer.ExitWithSignalCode = false
+		closer.DumpOnSIGQUIT = true
+		closer.Logger = logFunc(func(format string, v ...interface{}) {
+			if strings.Contains(fmt.Sprintf(format, v...), "goroutine ") {
+				dumped = true
+			}
+		})
+		closer.SetSignals(syscall.SIGQUIT)
+		closer.Defer(func() {
+			if dumped {
+				closer.ExitCodeErr = 58
+			}
+		})
+		childReady()
+		select {}
+	}
+	if err := signalChild("TestDumpOnSIGQUIT", []os.Signal{syscall.SIGQUIT}, "TEST_QUIT=1"); err == nil || !strings.Contains(err.Error(), "58") {
+		t.Fatalf("unexpected exit code: %v", err)
+	}
+}
+
+type logFunc func(format string, v ...interface{})
+
+func (fn logFunc) Printf(format string, v ...interface{}) { fn(format, v...) }
+
+// childReady tells signalChild the child is done setting up.
+func childReady() {
+	fmt.Println(readyLine)
+}
+
+// signalChild runs the test named test in a child process with env set,
+// sends it sigs once it's ready and waits for it to exit.
+func signalChild(test string, sigs []os.Signal, env ...string) error {
+	cmd := exec.Command(os.Args[0], "-test.run=^"+test+"$")
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	sc := bufio.NewScanner(out)
+	for sc.Scan() && sc.Text() != readyLine {
+	}
+	go io.Copy(io.Discard, out)
+	for _, sig := range sigs {
+		time.Sleep(time.Millisecond * 10)
+		cmd.Process.Signal(sig)
 	}
+	return cmd.Wait()
 }
@@ -0,0 +1,45 @@
+//go:build !windows
+
+package closer_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/OneOfOne/closer"
+)
+
+func TestAddSignalNone(t *testing.T) {
+	exited := make(chan int, 1)
+	closer.ExitFunc = func(code int) { exited <- code }
+	defer func() { closer.ExitFunc = os.Exit }()
+
+	c := closer.New(closer.WithSignals(syscall.SIGTERM))
+	defer c.Stop()
+	c.AddSignal()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGWINCH); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-exited:
+		t.Fatalf("SIGWINCH triggered the cleanup, exit code %d", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSetSignalActionNotify(t *testing.T) {
+	custom := make(chan os.Signal, 1)
+	c := closer.New(closer.WithNoExit())
+	defer c.Stop()
+	c.SetSignalAction(syscall.SIGUSR1, closer.Custom(func(sig os.Signal) { custom <- sig }))
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-custom:
+	case <-time.After(time.Second):
+		t.Fatal("SIGUSR1 wasn't handled")
+	}
+}
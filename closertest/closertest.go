@@ -0,0 +1,34 @@
+// Package closertest provides helpers to test the shutdown sequences built with closer.
+package closertest
+
+import "sync"
+
+// Recorder returns a register func that creates closers recording their name when they run,
+// and an order func that returns the names recorded so far, in the order the closers ran.
+// example:
+//
+//	rec, order := closertest.Recorder()
+//	c := closer.New()
+//	c.Defer(rec("db"))
+//	c.Defer(rec("cache"))
+//	c.Close()
+//	// order() == []string{"cache", "db"}
+func Recorder() (register func(name string) func(), order func() []string) {
+	var (
+		mux   sync.Mutex
+		names []string
+	)
+	register = func(name string) func() {
+		return func() {
+			mux.Lock()
+			names = append(names, name)
+			mux.Unlock()
+		}
+	}
+	order = func() []string {
+		mux.Lock()
+		defer mux.Unlock()
+		return append([]string(nil), names...)
+	}
+	return
+}
@@ -0,0 +1,21 @@
+package closertest_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/OneOfOne/closer"
+	"github.com/OneOfOne/closer/closertest"
+)
+
+func TestRecorder(t *testing.T) {
+	rec, order := closertest.Recorder()
+	c := closer.New()
+	c.Defer(rec("db"))
+	c.DeferP(1, rec("metrics"))
+	c.Defer(rec("cache"))
+	c.Close()
+	if got := fmt.Sprint(order()); got != "[metrics cache db]" {
+		t.Fatalf("unexpected order: %s", got)
+	}
+}
@@ -0,0 +1,62 @@
+package closer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrShutdown is the cause passed to the context.CancelCauseFunc closers.
+var ErrShutdown = errors.New("closer: graceful shutdown")
+
+// ErrAlreadyRan is returned by the funcs returned by DeferE when the funcs they trigger already ran or were cancelled.
+var ErrAlreadyRan = errors.New("closer: already ran")
+
+// ErrTooManyClosers matches every *TooManyClosersError with errors.Is.
+var ErrTooManyClosers = errors.New("closer: too many closers")
+
+// TooManyClosersError is reported when registering funcs would exceed MaxClosers, the funcs are dropped.
+type TooManyClosersError struct {
+	Dropped int // the number of funcs dropped
+	Max     int // the value of MaxClosers at the time
+}
+
+func (e *TooManyClosersError) Error() string {
+	return fmt.Sprintf("closer: too many closers, dropped %d funcs over the limit of %d", e.Dropped, e.Max)
+}
+
+// Is reports whether target is ErrTooManyClosers.
+func (e *TooManyClosersError) Is(target error) bool { return target == ErrTooManyClosers }
+
+// joinErrors returns nil for no errors, the error itself for a single one and errors.Join(errs...) otherwise,
+// so errors.Is and errors.As match any of them.
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
+
+// ErrPanic matches every *PanicError with errors.Is, to tell panics apart from returned errors.
+var ErrPanic = errors.New("closer: func panicked")
+
+// PanicError is returned for a defered func that panicked.
+type PanicError struct {
+	Value interface{} // the value passed to panic
+	Stack []byte      // the stack trace of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Is reports whether target is ErrPanic.
+func (e *PanicError) Is(target error) bool { return target == ErrPanic }
+
+// Unwrap returns the value passed to panic if it's an error, so errors.Is and errors.As can match it.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
@@ -0,0 +1,198 @@
+package closer
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// CloseEvent describes the execution of a single defered func.
+type CloseEvent struct {
+	Index    int    // registration index of the func
+	Name     string // name of the func, if it was registered with DeferNamed
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+	Summary  string // the summary returned by a func() (string, error)
+}
+
+// Report describes a whole cleanup, as returned by CloseReport.
+type Report struct {
+	Duration  time.Duration // how long the cleanup took
+	Attempted int           // the number of funcs that ran
+	Errored   int           // the number of funcs that failed
+	Closers   []CloseEvent  // the funcs that ran, in the order they returned
+}
+
+func (r *Report) add(ev CloseEvent) {
+	r.Attempted++
+	if ev.Err != nil {
+		r.Errored++
+	}
+	r.Closers = append(r.Closers, ev)
+}
+
+var jsonMux sync.Mutex
+
+// jsonRecord is a line written to JSONLog, a func record or the summary of a cleanup.
+type jsonRecord struct {
+	Name       string  `json:"name,omitempty"`
+	Summary    string  `json:"summary,omitempty"`
+	Closers    *int    `json:"closers,omitempty"`
+	Errored    *int    `json:"errored,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      *string `json:"error"`
+}
+
+// writeJSON writes rec to JSONLog as a single line, if it is set.
+func writeJSON(rec jsonRecord) {
+	jsonMux.Lock()
+	defer jsonMux.Unlock()
+	if JSONLog == nil {
+		return
+	}
+	json.NewEncoder(JSONLog).Encode(rec)
+}
+
+func jsonErr(err error) *string {
+	if err == nil {
+		return nil
+	}
+	s := err.Error()
+	return &s
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// eventSub queues events for a single Events channel so emitting them never blocks.
+type eventSub struct {
+	mux     sync.Mutex
+	queue   []CloseEvent
+	pending int           // the events pushed but not received yet
+	idle    chan struct{} // closed once pending drops to 0, see wait
+	closed  bool
+	wake    chan struct{}
+	out     chan CloseEvent
+}
+
+func newEventSub() *eventSub {
+	s := &eventSub{
+		wake: make(chan struct{}, 1),
+		out:  make(chan CloseEvent),
+	}
+	go s.forward()
+	return s
+}
+
+func (s *eventSub) push(ev CloseEvent) {
+	s.mux.Lock()
+	s.queue = append(s.queue, ev)
+	s.pending++
+	s.mux.Unlock()
+	s.notify()
+}
+
+func (s *eventSub) close() {
+	s.mux.Lock()
+	s.closed = true
+	s.mux.Unlock()
+	s.notify()
+}
+
+func (s *eventSub) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *eventSub) forward() {
+	for {
+		s.mux.Lock()
+		q, closed := s.queue, s.closed
+		s.queue = nil
+		s.mux.Unlock()
+		if len(q) == 0 {
+			if closed {
+				close(s.out)
+				return
+			}
+			<-s.wake
+			continue
+		}
+		for _, ev := range q {
+			s.out <- ev
+			s.done()
+		}
+	}
+}
+
+// done marks a pushed event as received.
+func (s *eventSub) done() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.pending--; s.pending == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// wait blocks until the pushed events were all received, or ctx is done.
+func (s *eventSub) wait(ctx context.Context) error {
+	s.mux.Lock()
+	if s.pending == 0 {
+		s.mux.Unlock()
+		return nil
+	}
+	if s.idle == nil {
+		s.idle = make(chan struct{})
+	}
+	idle := s.idle
+	s.mux.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Closer) emit(ev CloseEvent) {
+	c.evMux.Lock()
+	defer c.evMux.Unlock()
+	for _, s := range c.evSubs {
+		s.push(ev)
+	}
+}
+
+// closeEvents closes all the Events channels of c, and the ones returned by Events from now on.
+func (c *Closer) closeEvents() {
+	c.evMux.Lock()
+	defer c.evMux.Unlock()
+	c.evDone = true
+	for _, s := range c.evSubs {
+		s.close()
+	}
+	c.evClosed = append(c.evClosed, c.evSubs...)
+	c.evSubs = nil
+}
+
+// flushEvents waits for the events emitted by c to be received, on the open and closed Events channels.
+func (c *Closer) flushEvents(ctx context.Context) error {
+	c.evMux.Lock()
+	closed := len(c.evClosed)
+	subs := append(c.evSubs[:len(c.evSubs):len(c.evSubs)], c.evClosed...)
+	c.evMux.Unlock()
+	for _, s := range subs {
+		if err := s.wait(ctx); err != nil {
+			return err
+		}
+	}
+	c.evMux.Lock()
+	c.evClosed = c.evClosed[closed:] // nothing will be pushed to the drained closed ones anymore
+	c.evMux.Unlock()
+	return nil
+}
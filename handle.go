@@ -0,0 +1,60 @@
+package closer
+
+// Handle refers to the funcs registered by a single DeferHandle call.
+type Handle struct {
+	c   *Closer
+	cfs closerFuncs
+	err error // set when the funcs were dropped because of MaxClosers
+}
+
+// Run executes the funcs of h in a LIFO order and removes them from the closer,
+// it's a no-op if they already ran or were cancelled.
+func (h *Handle) Run() {
+	h.RunE()
+}
+
+// RunE is like Run, except it returns the errors of the funcs that failed, joined with errors.Join,
+// and ErrAlreadyRan if none of them was left to run, or the *TooManyClosersError if they were dropped.
+func (h *Handle) RunE() error {
+	if h.err != nil {
+		return h.err
+	}
+	c := h.c
+	c.mux.Lock()
+	cfs := h.cfs.active()
+	c.mux.Unlock()
+	if len(cfs) == 0 {
+		return ErrAlreadyRan
+	}
+	return c.runNow(cfs)
+}
+
+// After makes the funcs of h run after the funcs of deps, it returns h.
+// Dependencies between handles of different closers, or on funcs that already ran, are ignored.
+// If they form a cycle, it is reported like the funcs' errors and broken by running the first func of the cycle
+// in the usual order.
+func (h *Handle) After(deps ...*Handle) *Handle {
+	c := h.c
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, cf := range h.cfs {
+		for _, dep := range deps {
+			if dep.c == c {
+				cf.after = append(cf.after, dep.cfs...)
+			}
+		}
+	}
+	return h
+}
+
+// Cancel removes the funcs of h from the closer without running them,
+// it's a no-op if they already ran or were cancelled.
+func (h *Handle) Cancel() {
+	c := h.c
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, cf := range h.cfs {
+		c.take(cf)
+	}
+	c.closers = c.closers.pending()
+}
@@ -0,0 +1,39 @@
+package closer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// serverCloser returns a func that gracefully shuts srv down, waiting up to timeout for the active connections,
+// and forcibly closes it if they don't finish in time.
+func serverCloser(srv *http.Server, timeout time.Duration) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		err := srv.Shutdown(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return srv.Close()
+		}
+		return err
+	}
+}
+
+// DeferServer registers srv to be gracefully shut down with srv.Shutdown,
+// if the active connections don't finish within timeout, srv.Close is called instead.
+// A timeout <= 0 means Shutdown is only bound by the cleanup context, see CleanupTimeout.
+// returns a func() that shuts srv down.
+func (c *Closer) DeferServer(srv *http.Server, timeout time.Duration) func() {
+	return c.Defer(serverCloser(srv, timeout))
+}
+
+// DeferServer registers srv to be gracefully shut down, falling back to srv.Close after timeout.
+// See (*Closer).DeferServer.
+func DeferServer(srv *http.Server, timeout time.Duration) func() {
+	return get().DeferServer(srv, timeout)
+}
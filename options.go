@@ -0,0 +1,46 @@
+package closer
+
+import (
+	"os"
+	"time"
+)
+
+// Option configures a Closer created by New.
+type Option func(*Closer)
+
+// WithSignals makes the Closer handle signals instead of DefaultSignals().
+func WithSignals(signals ...os.Signal) Option {
+	return func(c *Closer) { c.signals = append([]os.Signal(nil), signals...) }
+}
+
+// WithTimeout bounds the cleanups of the Closer instead of CleanupTimeout, see CleanupTimeout.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Closer) { c.timeout = d }
+}
+
+// WithLogger makes the Closer log to l instead of Logger.
+func WithLogger(l Printfer) Option {
+	return func(c *Closer) { c.logger = l }
+}
+
+// WithNoExit makes the signal handler of the Closer never call ExitFunc, see (*Closer).NoExit.
+func WithNoExit() Option {
+	return func(c *Closer) { c.noExit = true }
+}
+
+// WithExitFunc makes the Closer terminate the process with fn instead of ExitFunc.
+func WithExitFunc(fn func(code int)) Option {
+	return func(c *Closer) { c.exitFunc = fn }
+}
+
+// WithSyncSignal makes the Closer start in sync mode, where the cleanup triggered by a signal
+// runs on the goroutine calling (*Closer).ServeSignals.
+func WithSyncSignal() Option {
+	return func(c *Closer) { c.served = make(chan servedSignal) }
+}
+
+// WithCloseAll makes CloseAll drain the Closer along with the global one, until it's drained or stopped.
+// Without it, a Closer is only drained through its own methods, so a library's closer isn't drained by its host.
+func WithCloseAll() Option {
+	return func(c *Closer) { c.shared = true }
+}
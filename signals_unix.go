@@ -0,0 +1,22 @@
+//go:build !windows
+
+package closer
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignal is the signal that triggers the reload handlers.
+var reloadSignal os.Signal = syscall.SIGHUP
+
+// quitSignal is the signal that dumps the goroutines when DumpOnSIGQUIT is set.
+var quitSignal os.Signal = syscall.SIGQUIT
+
+func defaultSignals() []os.Signal {
+	return []os.Signal{
+		syscall.SIGINT,
+		syscall.SIGHUP,
+		syscall.SIGTERM,
+	}
+}
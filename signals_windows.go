@@ -0,0 +1,19 @@
+package closer
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignal is nil since windows has no SIGHUP.
+var reloadSignal os.Signal
+
+// quitSignal is nil since windows has no SIGQUIT.
+var quitSignal os.Signal
+
+func defaultSignals() []os.Signal {
+	return []os.Signal{
+		os.Interrupt,
+		syscall.SIGTERM, // delivered on console close, logoff and shutdown events
+	}
+}
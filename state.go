@@ -0,0 +1,59 @@
+package closer
+
+// ShutdownState is the shutdown state of a closer, as returned by State.
+// It only moves forward, until Reset brings it back to Running:
+//
+//	Running --signal--> Draining --cleanup starts--> Closing --cleanup done--> Closed
+//	Running --Close, Exit or a crash-------------->  Closing
+//
+// signals handed to Wait, reloads, ignored and held signals don't change it.
+type ShutdownState int
+
+const (
+	// Running is the state of a closer that didn't catch a signal or start its cleanup.
+	Running ShutdownState = iota
+	// Draining means a signal was caught and the cleanup is about to start, see (*Closer).Context.
+	Draining
+	// Closing means the defered funcs are running.
+	Closing
+	// Closed means the cleanup is done, see (*Closer).Done.
+	Closed
+)
+
+func (s ShutdownState) String() string {
+	switch s {
+	case Running:
+		return "running"
+	case Draining:
+		return "draining"
+	case Closing:
+		return "closing"
+	case Closed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// State returns the shutdown state of c, e.g. for a readiness endpoint to fail as soon as it isn't Running.
+func (c *Closer) State() ShutdownState {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.drained {
+		select {
+		case <-c.drainDone:
+			return Closed
+		default:
+			return Closing
+		}
+	}
+	if c.ctx.Err() != nil {
+		return Draining
+	}
+	return Running
+}
+
+// State returns the shutdown state of the global closer.
+// See (*Closer).State.
+func State() ShutdownState {
+	return get().State()
+}